@@ -0,0 +1,141 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// newStreamGCM returns an AES-256-GCM AEAD for the stream identified by
+// prefix. GCM only has room for a 96-bit nonce, which isn't enough for both a
+// NoncePrefix and a block number, so each stream gets its own key derived
+// from key and prefix with HMAC-SHA256 instead.
+func newStreamGCM(key []byte, prefix NoncePrefix) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, Error.New("invalid key length, expected 32")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(prefix[:])
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	return aead, nil
+}
+
+func calcGCMNonce(blockNum int64, final bool) []byte {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], calcBlockCounter(blockNum, final))
+	return nonce[:]
+}
+
+type aesgcmEncrypter struct {
+	blockSize int
+	aead      cipher.AEAD
+}
+
+// NewAESGCMEncrypter returns a Transformer that encrypts the data passing
+// through with AES-256-GCM and key. prefix must be unique for every stream
+// encrypted with key, and is needed again to decrypt it. Like the secretbox
+// encrypter, it marks the final block.
+func NewAESGCMEncrypter(key []byte, prefix NoncePrefix,
+	encryptedBlockSize int) (Transformer, error) {
+	aead, err := newStreamGCM(key, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if encryptedBlockSize <= aead.Overhead() {
+		return nil, Error.New("block size too small")
+	}
+	return &aesgcmEncrypter{
+		blockSize: encryptedBlockSize - aead.Overhead(),
+		aead:      aead,
+	}, nil
+}
+
+func (s *aesgcmEncrypter) InBlockSize() int {
+	return s.blockSize
+}
+
+func (s *aesgcmEncrypter) OutBlockSize() int {
+	return s.blockSize + s.aead.Overhead()
+}
+
+// Inverse implements InvertibleTransformer.
+func (s *aesgcmEncrypter) Inverse() Transformer {
+	return &aesgcmDecrypter{blockSize: s.blockSize, aead: s.aead}
+}
+
+func (s *aesgcmEncrypter) Transform(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	return s.aead.Seal(out, calcGCMNonce(blockNum, false), in, nil), nil
+}
+
+func (s *aesgcmEncrypter) TransformFinal(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	return s.aead.Seal(out, calcGCMNonce(blockNum, true), in, nil), nil
+}
+
+type aesgcmDecrypter struct {
+	blockSize int
+	aead      cipher.AEAD
+}
+
+// NewAESGCMDecrypter returns a Transformer that decrypts the data passing
+// through with AES-256-GCM and key. prefix must be the NoncePrefix the data
+// was encrypted with.
+func NewAESGCMDecrypter(key []byte, prefix NoncePrefix,
+	encryptedBlockSize int) (Transformer, error) {
+	aead, err := newStreamGCM(key, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if encryptedBlockSize <= aead.Overhead() {
+		return nil, Error.New("block size too small")
+	}
+	return &aesgcmDecrypter{
+		blockSize: encryptedBlockSize - aead.Overhead(),
+		aead:      aead,
+	}, nil
+}
+
+func (s *aesgcmDecrypter) InBlockSize() int {
+	return s.blockSize + s.aead.Overhead()
+}
+
+func (s *aesgcmDecrypter) OutBlockSize() int {
+	return s.blockSize
+}
+
+// Inverse implements InvertibleTransformer.
+func (s *aesgcmDecrypter) Inverse() Transformer {
+	return &aesgcmEncrypter{blockSize: s.blockSize, aead: s.aead}
+}
+
+func (s *aesgcmDecrypter) Transform(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	return s.open(out, in, blockNum, false)
+}
+
+func (s *aesgcmDecrypter) TransformFinal(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	return s.open(out, in, blockNum, true)
+}
+
+func (s *aesgcmDecrypter) open(out, in []byte, blockNum int64,
+	final bool) ([]byte, error) {
+	rv, err := s.aead.Open(out, calcGCMNonce(blockNum, final), in, nil)
+	if err != nil {
+		return nil, Error.New("failed decrypting")
+	}
+	return rv, nil
+}
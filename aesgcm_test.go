@@ -0,0 +1,55 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jtolds/eestream/ranger"
+)
+
+func TestAESGCM(t *testing.T) {
+	key := randData(32)
+	prefix, err := NewNoncePrefix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypter, err := NewAESGCMEncrypter(key, prefix, 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := randData(encrypter.InBlockSize() * 10)
+	encrypted, err := ioutil.ReadAll(TransformReader(bytes.NewReader(data),
+		encrypter, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypter, err := NewAESGCMDecrypter(key, prefix, 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := Transform(ranger.ByteRanger(encrypted), decrypter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Size() != int64(len(data)) {
+		t.Fatalf("unexpected decrypted size %d", rr.Size())
+	}
+	offset, length := int64(5000), int64(20000)
+	data2, err := ioutil.ReadAll(rr.Range(offset, length))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[offset:offset+length], data2) {
+		t.Fatalf("encryption/decryption failed")
+	}
+
+	// blocks can't be moved around
+	block := encrypted[:encrypter.OutBlockSize()]
+	if _, err := decrypter.Transform(nil, block, 1); err == nil {
+		t.Fatalf("expected decrypting a moved block to fail")
+	}
+}
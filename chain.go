@@ -0,0 +1,136 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+// An InvertibleTransformer is a Transformer that knows the Transformer that
+// undoes it, such as an encrypter and its decrypter.
+type InvertibleTransformer interface {
+	Transformer
+
+	// Inverse returns a Transformer whose Transform undoes this one's.
+	Inverse() Transformer
+}
+
+type chain struct {
+	stages []Transformer
+}
+
+// Chain returns a Transformer that applies every one of stages to each
+// block in turn. Each stage's OutBlockSize must match the next stage's
+// InBlockSize. If any stage is a FinalBlockTransformer, so is the chain.
+func Chain(stages ...Transformer) (Transformer, error) {
+	if len(stages) == 0 {
+		return nil, Error.New("empty transformer chain")
+	}
+	final := false
+	for i, t := range stages {
+		if i > 0 && stages[i-1].OutBlockSize() != t.InBlockSize() {
+			return nil, Error.New("transformer chain stage %d outputs %d byte "+
+				"blocks, but stage %d takes %d byte blocks", i-1,
+				stages[i-1].OutBlockSize(), i, t.InBlockSize())
+		}
+		if _, ok := t.(FinalBlockTransformer); ok {
+			final = true
+		}
+	}
+	c := &chain{stages: append([]Transformer(nil), stages...)}
+	if final {
+		return &finalChain{chain: c}, nil
+	}
+	return c, nil
+}
+
+func (c *chain) InBlockSize() int {
+	return c.stages[0].InBlockSize()
+}
+
+func (c *chain) OutBlockSize() int {
+	return c.stages[len(c.stages)-1].OutBlockSize()
+}
+
+func (c *chain) Transform(out, in []byte, blockNum int64) ([]byte, error) {
+	return c.transform(out, in, blockNum, false)
+}
+
+func (c *chain) transform(out, in []byte, blockNum int64, last bool) (
+	[]byte, error) {
+	// the chain may be used by several Readers at once, so intermediate
+	// blocks come from the block pool. scratch is the pooled buffer in is
+	// held in, if any.
+	var scratch []byte
+	for i, t := range c.stages {
+		dst, buf := out, []byte(nil)
+		if i < len(c.stages)-1 {
+			buf = getBlock(t.OutBlockSize())
+			dst = buf[:0]
+		}
+		var result []byte
+		var err error
+		if final, ok := t.(FinalBlockTransformer); ok && last {
+			result, err = final.TransformFinal(dst, in, blockNum)
+		} else {
+			result, err = t.Transform(dst, in, blockNum)
+		}
+		// a stage may hand back its input instead of writing to dst, so only
+		// the buffers the result isn't held in are done with.
+		switch {
+		case err == nil && sameBuffer(result, buf):
+			putBlock(scratch)
+			scratch = buf
+		case err == nil && sameBuffer(result, scratch):
+			putBlock(buf)
+		default:
+			putBlock(buf)
+			putBlock(scratch)
+			scratch = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		in = result
+	}
+	// if the result is still in a pooled buffer, it's the caller's now.
+	return in, nil
+}
+
+// sameBuffer returns true if a and b are slices of the same buffer.
+func sameBuffer(a, b []byte) bool {
+	return cap(a) > 0 && cap(b) > 0 &&
+		&a[:cap(a)][cap(a)-1] == &b[:cap(b)][cap(b)-1]
+}
+
+type finalChain struct {
+	*chain
+}
+
+func (c *finalChain) TransformFinal(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	return c.transform(out, in, blockNum, true)
+}
+
+// Invert returns the Transformer that undoes t. t must either be an
+// InvertibleTransformer or a Chain of them, in which case the inverses are
+// chained in reverse order.
+func Invert(t Transformer) (Transformer, error) {
+	var c *chain
+	switch t := t.(type) {
+	case *chain:
+		c = t
+	case *finalChain:
+		c = t.chain
+	case InvertibleTransformer:
+		return t.Inverse(), nil
+	default:
+		return nil, Error.New("transformer %T has no inverse", t)
+	}
+	inverses := make([]Transformer, 0, len(c.stages))
+	for i := len(c.stages) - 1; i >= 0; i-- {
+		inverse, err := Invert(c.stages[i])
+		if err != nil {
+			return nil, err
+		}
+		inverses = append(inverses, inverse)
+	}
+	return Chain(inverses...)
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jtolds/eestream/ranger"
+)
+
+// passthrough is a Transformer that hands back its input as is.
+type passthrough int
+
+func (p passthrough) InBlockSize() int  { return int(p) }
+func (p passthrough) OutBlockSize() int { return int(p) }
+
+func (p passthrough) Transform(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	return in, nil
+}
+
+func (p passthrough) Inverse() Transformer { return p }
+
+func TestChain(t *testing.T) {
+	key := randData(32)
+	prefix, err := NewNoncePrefix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := NewSecretboxEncrypter(key, prefix, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer, err := NewAESGCMEncrypter(key, prefix, inner.OutBlockSize()+16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Chain(outer, inner); err == nil {
+		t.Fatalf("expected mismatched block sizes to fail")
+	}
+	encrypter, err := Chain(inner, outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypter.InBlockSize() != inner.InBlockSize() ||
+		encrypter.OutBlockSize() != outer.OutBlockSize() {
+		t.Fatalf("unexpected chain block sizes")
+	}
+	if _, ok := encrypter.(FinalBlockTransformer); !ok {
+		t.Fatalf("expected the chain to mark the final block")
+	}
+	decrypter, err := Invert(encrypter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := randData(encrypter.InBlockSize() * 5)
+	encrypted, err := ioutil.ReadAll(TransformReader(bytes.NewReader(data),
+		encrypter, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := Transform(ranger.ByteRanger(encrypted), decrypter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := ioutil.ReadAll(rr.Range(0, rr.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, decrypted) {
+		t.Fatalf("chain round trip failed")
+	}
+
+	// the stages of the inverse can be checked one at a time
+	innerDecrypter, err := Invert(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outerDecrypter, err := Invert(outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypter, err = Chain(outerDecrypter, innerDecrypter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err = ioutil.ReadAll(TransformReader(
+		bytes.NewReader(encrypted), decrypter, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, decrypted) {
+		t.Fatalf("manual inverse chain failed")
+	}
+
+	// truncation is still noticed through the chain
+	_, err = ioutil.ReadAll(TransformReader(bytes.NewReader(
+		encrypted[:len(encrypted)-encrypter.OutBlockSize()]), decrypter, 0))
+	if !TruncatedError.Contains(err) {
+		t.Fatalf("expected truncation error, got %v", err)
+	}
+
+	// stages that hand back their input don't have it recycled under them
+	encrypter, err = Chain(passthrough(inner.InBlockSize()), inner,
+		passthrough(inner.OutBlockSize()), outer,
+		passthrough(outer.OutBlockSize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted2, err := ioutil.ReadAll(TransformReader(bytes.NewReader(data),
+		encrypter, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encrypted, encrypted2) {
+		t.Fatalf("passthrough stages changed the chain's output")
+	}
+
+	crc, err := Chain(newCRCAdder(crc32.IEEETable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := crc.(FinalBlockTransformer); ok {
+		t.Fatalf("chain shouldn't mark the final block")
+	}
+	if _, err := Invert(crc); err == nil {
+		t.Fatalf("expected inverting a chain without inverses to fail")
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+// Package passphrase reads the passphrases the commands derive their
+// encryption keys from.
+package passphrase
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// A Source reads a passphrase from a file, an environment variable, or the
+// terminal, as configured by its flags.
+type Source struct {
+	name string
+	flag string
+	file *string
+	env  *string
+}
+
+// NewSource registers the flags -<flagPrefix>_file and -<flagPrefix>_env for
+// a passphrase called name. The environment variable defaults to env.
+func NewSource(flagPrefix, env, name string) *Source {
+	return &Source{
+		name: name,
+		flag: flagPrefix,
+		file: flag.String(flagPrefix+"_file", "",
+			fmt.Sprintf("read the %s from this file", name)),
+		env: flag.String(flagPrefix+"_env", env,
+			fmt.Sprintf("read the %s from this environment variable if it's "+
+				"set", name)),
+	}
+}
+
+var defaultSource = NewSource("key", "EESTREAM_KEY", "passphrase")
+
+// Read reads the passphrase configured by -key_file and -key_env. See
+// Source.Read.
+func Read(confirm bool) ([]byte, error) {
+	return defaultSource.Read(confirm)
+}
+
+// Read returns the passphrase from the file named by the _file flag, or else
+// the environment variable named by the _env flag, or else prompts for it on
+// the terminal. If confirm is true, a prompted passphrase has to be typed
+// twice.
+func (s *Source) Read(confirm bool) ([]byte, error) {
+	if *s.file != "" {
+		data, err := ioutil.ReadFile(*s.file)
+		if err != nil {
+			return nil, err
+		}
+		return s.check(bytes.TrimRight(data, "\r\n"))
+	}
+	if *s.env != "" {
+		if v := os.Getenv(*s.env); v != "" {
+			return s.check([]byte(v))
+		}
+	}
+	return s.prompt(confirm)
+}
+
+func (s *Source) check(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty %s", s.name)
+	}
+	return passphrase, nil
+}
+
+// prompt reads the passphrase from the controlling terminal rather than
+// stdin, which may be carrying data.
+func (s *Source) prompt(confirm bool) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil || !terminal.IsTerminal(int(tty.Fd())) {
+		if tty != nil {
+			tty.Close()
+		}
+		return nil, fmt.Errorf("no %s given; use -%s_file, $%s, or run from "+
+			"a terminal", s.name, s.flag, *s.env)
+	}
+	defer tty.Close()
+	read := func(msg string) ([]byte, error) {
+		fmt.Fprint(tty, msg)
+		defer fmt.Fprintln(tty)
+		return terminal.ReadPassword(int(tty.Fd()))
+	}
+	passphrase, err := read(s.name + ": ")
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		again, err := read(s.name + " again: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("passphrases don't match")
+		}
+	}
+	return s.check(passphrase)
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jtolds/eestream"
+)
+
+func main() {
+	flag.Parse()
+	if flag.Arg(0) == "" {
+		fmt.Printf("usage: %s <identityfile>\n", os.Args[0])
+		os.Exit(1)
+	}
+	err := Main()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Main writes a new Identity to a file, for cmd/serve -identity, and prints
+// its public key, for cmd/store -recipient.
+func Main() error {
+	id, err := eestream.NewIdentity()
+	if err != nil {
+		return err
+	}
+	text, err := id.MarshalText()
+	if err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(flag.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(append(text, '\n'))
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	err = fh.Close()
+	if err != nil {
+		return err
+	}
+	pub, err := id.PublicKey.MarshalText()
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(pub))
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/jtolds/eestream"
+	"github.com/jtolds/eestream/cmd/internal/passphrase"
+	"github.com/jtolds/eestream/ranger"
+)
+
+var newPassphrase = passphrase.NewSource("new_key", "EESTREAM_NEW_KEY",
+	"new passphrase")
+
+func main() {
+	flag.Parse()
+	if flag.Arg(0) == "" {
+		fmt.Printf("usage: %s <targetdir>\n", os.Args[0])
+		os.Exit(1)
+	}
+	err := Main()
+	if err != nil {
+		panic(err)
+	}
+}
+
+type piece struct {
+	header     *eestream.PieceHeader
+	headerSize int64
+}
+
+// Main changes the passphrase the data key of the pieces in a directory is
+// wrapped with. Only the piece headers are rewritten. The new headers are
+// journaled first, so if Main is interrupted while rewriting them, the next
+// run finishes the job instead of starting a new one.
+func Main() error {
+	dir := flag.Arg(0)
+	journal, err := readJournal(dir)
+	if err != nil {
+		return err
+	}
+	if journal != nil {
+		fmt.Println("finishing an interrupted rekey")
+		return applyJournal(dir, journal)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.piece"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no pieces found")
+	}
+	pieces := make([]piece, 0, len(paths))
+	for _, path := range paths {
+		fh, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		fs, err := fh.Stat()
+		if err != nil {
+			return err
+		}
+		h, data, err := eestream.ParsePiece(ranger.ReaderAtRanger(fh, fs.Size()))
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		pieces = append(pieces, piece{
+			header:     h,
+			headerSize: fs.Size() - data.Size(),
+		})
+	}
+	// every piece has to carry the same keys, so the new keys are wrapped once
+	// and written to all of them.
+	first := pieces[0].header
+	for i, p := range pieces {
+		if p.header.KeySalt != first.KeySalt ||
+			!reflect.DeepEqual(p.header.WrappedKeys, first.WrappedKeys) {
+			return fmt.Errorf("%s: keys don't match %s", paths[i], paths[0])
+		}
+	}
+
+	oldPass, err := passphrase.Read(false)
+	if err != nil {
+		return err
+	}
+	oldKEK, err := eestream.PassphraseKey(oldPass, first.KeySalt)
+	if err != nil {
+		return err
+	}
+	newPass, err := newPassphrase.Read(true)
+	if err != nil {
+		return err
+	}
+	newSalt, err := eestream.NewKeySalt()
+	if err != nil {
+		return err
+	}
+	newKEK, err := eestream.PassphraseKey(newPass, newSalt)
+	if err != nil {
+		return err
+	}
+	newKeys, err := eestream.RewrapKey(oldKEK, newKEK, first.WrappedKeys)
+	if err != nil {
+		return err
+	}
+
+	journal = make([]journalEntry, 0, len(pieces))
+	for i, p := range pieces {
+		p.header.KeySalt = newSalt
+		p.header.WrappedKeys = newKeys
+		buf, err := p.header.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		// the header is rewritten in place, so it can't change size.
+		if int64(len(buf)) != p.headerSize {
+			return fmt.Errorf("%s: header size changed", paths[i])
+		}
+		journal = append(journal, journalEntry{
+			Piece:  filepath.Base(paths[i]),
+			Header: buf,
+		})
+	}
+	err = writeJournal(dir, journal)
+	if err != nil {
+		return err
+	}
+	return applyJournal(dir, journal)
+}
+
+// journalName is the file in a piece directory holding the new headers of a
+// rekey until every piece has them.
+const journalName = "rekey.journal"
+
+type journalEntry struct {
+	Piece  string
+	Header []byte
+}
+
+// readJournal returns the journal in dir, or nil if there isn't one.
+func readJournal(dir string) ([]journalEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, journalName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var journal []journalEntry
+	err = json.Unmarshal(data, &journal)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", journalName, err)
+	}
+	return journal, nil
+}
+
+// writeJournal durably writes journal to dir. It's written to a temporary
+// file first, so a journal is only ever seen whole.
+func writeJournal(dir string, journal []journalEntry) (err error) {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	fh, err := ioutil.TempFile(dir, journalName+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = fh.Close()
+			_ = os.Remove(fh.Name())
+		}
+	}()
+	_, err = fh.Write(data)
+	if err != nil {
+		return err
+	}
+	err = fh.Sync()
+	if err != nil {
+		return err
+	}
+	err = fh.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(fh.Name(), filepath.Join(dir, journalName))
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// applyJournal writes the headers in journal over the headers of their
+// pieces, and removes the journal once they're all durable.
+func applyJournal(dir string, journal []journalEntry) error {
+	for _, e := range journal {
+		err := writeHeader(filepath.Join(dir, e.Piece), e.Header)
+		if err != nil {
+			return fmt.Errorf("%s: %v", e.Piece, err)
+		}
+	}
+	err := os.Remove(filepath.Join(dir, journalName))
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// writeHeader replaces the header of the piece at path with header, which
+// has to be the same size.
+func writeHeader(path string, header []byte) error {
+	fh, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	fs, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	_, data, err := eestream.ParsePiece(ranger.ReaderAtRanger(fh, fs.Size()))
+	if err != nil {
+		return err
+	}
+	if int64(len(header)) != fs.Size()-data.Size() {
+		return fmt.Errorf("header size changed")
+	}
+	_, err = fh.WriteAt(header, 0)
+	if err != nil {
+		return err
+	}
+	return fh.Sync()
+}
+
+// syncDir syncs the directory at path, so the renames in it are durable.
+func syncDir(path string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return fh.Sync()
+}
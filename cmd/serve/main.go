@@ -4,28 +4,35 @@
 package main
 
 import (
-	"crypto/sha256"
+	"bytes"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
-	"time"
 
 	"github.com/jtolds/eestream"
+	"github.com/jtolds/eestream/cmd/internal/passphrase"
 	"github.com/jtolds/eestream/ranger"
-	"github.com/vivint/infectious"
 )
 
 var (
-	addr           = flag.String("addr", "localhost:8080", "address to serve from")
-	pieceBlockSize = flag.Int("piece_block_size", 4*1024, "block size of pieces")
-	key            = flag.String("key", "a key", "the secret key")
-	rsk            = flag.Int("required", 20, "rs required")
-	rsn            = flag.Int("total", 40, "rs total")
+	addr = flag.String("addr", "localhost:8080", "address to serve from")
+	root = flag.String("root", "",
+		"the known-good merkle root printed by cmd/store, to check reads "+
+			"against instead of the root in the piece headers. without it, "+
+			"reads are only checked against the headers, which are no more "+
+			"trustworthy than the pieces themselves")
+	noVerify = flag.Bool("no_verify", false,
+		"serve without checking reads against the merkle tree, such as "+
+			"when merkle.tree has been lost")
+	readAhead = flag.Int("read_ahead", 8,
+		"number of blocks to fetch and decode ahead of a reader")
+	identity = flag.String("identity", "",
+		"decrypt with this identity file from cmd/keygen instead of a "+
+			"passphrase")
 )
 
 func main() {
@@ -40,54 +47,131 @@ func main() {
 	}
 }
 
-func Main() error {
-	encKey := sha256.Sum256([]byte(*key))
-	fc, err := infectious.NewFEC(*rsk, *rsn)
+// unwrapDataKey returns the key the data was encrypted with, using the
+// -identity file if there is one, and the passphrase otherwise.
+func unwrapDataKey(header *eestream.PieceHeader) ([]byte, error) {
+	if *identity != "" {
+		text, err := ioutil.ReadFile(*identity)
+		if err != nil {
+			return nil, err
+		}
+		var id eestream.Identity
+		err = id.UnmarshalText(bytes.TrimSpace(text))
+		if err != nil {
+			return nil, err
+		}
+		return eestream.UnwrapKeyWithIdentity(&id, header.WrappedKeys)
+	}
+	pass, err := passphrase.Read(false)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	es := eestream.NewRSScheme(fc, *pieceBlockSize)
-	decrypter, err := eestream.NewSecretboxDecrypter(encKey[:],
-		es.DecodedBlockSize())
+	kek, err := eestream.PassphraseKey(pass, header.KeySalt)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return eestream.UnwrapKey(kek, header.WrappedKeys)
+}
+
+// verify checks every read of rr against the merkle tree stored with the
+// pieces, unless -no_verify is given. The tree is only optional if neither
+// -root nor the header has a root.
+func verify(rr ranger.Ranger, header *eestream.PieceHeader) (
+	ranger.Ranger, error) {
+	if *noVerify {
+		if *root != "" {
+			return nil, fmt.Errorf("-root can't be used with -no_verify")
+		}
+		return rr, nil
+	}
+	trusted := header.MerkleRoot
+	if *root != "" {
+		b, err := hex.DecodeString(*root)
+		if err != nil || len(b) != len(trusted) {
+			return nil, fmt.Errorf("invalid merkle root %q", *root)
+		}
+		copy(trusted[:], b)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(flag.Arg(0), "merkle.tree"))
+	if os.IsNotExist(err) {
+		if trusted == (eestream.MerkleRoot{}) {
+			return rr, nil
+		}
+		return nil, fmt.Errorf("merkle.tree is missing; use -no_verify to " +
+			"serve without checking reads")
+	}
+	if err != nil {
+		return nil, err
 	}
-	pieces, err := ioutil.ReadDir(flag.Arg(0))
+	var tree eestream.MerkleTree
+	err = tree.UnmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	if header.MerkleBlockSize != 0 &&
+		tree.BlockSize() != header.MerkleBlockSize {
+		return nil, fmt.Errorf("merkle tree has %d byte blocks, expected %d",
+			tree.BlockSize(), header.MerkleBlockSize)
+	}
+	return eestream.MerkleVerify(rr, &tree, trusted)
+}
+
+func Main() error {
+	paths, err := filepath.Glob(filepath.Join(flag.Arg(0), "*.piece"))
 	if err != nil {
 		return err
 	}
-	rrs := map[int]ranger.Ranger{}
-	for _, piece := range pieces {
-		piecenum, err := strconv.Atoi(strings.TrimSuffix(piece.Name(), ".piece"))
+	pieces := make([]ranger.Ranger, 0, len(paths))
+	for _, path := range paths {
+		fh, err := os.Open(path)
 		if err != nil {
 			return err
 		}
-		fh, err := os.Open(filepath.Join(flag.Arg(0), piece.Name()))
+		defer fh.Close()
+		fs, err := fh.Stat()
 		if err != nil {
 			return err
 		}
-		defer fh.Close()
-		fs, err := fh.Stat()
+		pieces = append(pieces, ranger.ReaderAtRanger(fh, fs.Size()))
+	}
+	rr, header, err := eestream.DecodePieces(pieces,
+		eestream.DecoderOptions{SkipLongTail: true, ReadAhead: *readAhead})
+	if err != nil {
+		return err
+	}
+	config, err := eestream.ParsePipelineSpec(header.Pipeline)
+	if err != nil {
+		return err
+	}
+	var dataKey []byte
+	if config.Cipher != "" {
+		dataKey, err = unwrapDataKey(header)
 		if err != nil {
 			return err
 		}
-		rrs[piecenum] = ranger.ReaderAtRanger(fh, fs.Size())
 	}
-	rr, err := eestream.Decode(rrs, es)
+	p, err := eestream.NewPipeline(config, dataKey, header.NoncePrefix)
 	if err != nil {
 		return err
 	}
-	rr, err = eestream.Transform(rr, decrypter)
+	rr, err = p.DecodeRanger(rr, &header.Manifest)
 	if err != nil {
 		return err
 	}
-	rr, err = eestream.UnpadSlow(rr)
+	rr, err = verify(rr, header)
 	if err != nil {
 		return err
 	}
+	name := header.Name
+	if name == "" {
+		name = filepath.Base(flag.Arg(0))
+	}
 
 	return http.ListenAndServe(*addr, http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			ranger.ServeContent(w, r, flag.Arg(0), time.Time{}, rr)
+			if header.ContentType != "" {
+				w.Header().Set("Content-Type", header.ContentType)
+			}
+			ranger.ServeContent(w, r, name, header.ModTime, rr)
 		}))
 }
@@ -4,24 +4,61 @@
 package main
 
 import (
-	"crypto/sha256"
+	"context"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"time"
 
 	"github.com/jtolds/eestream"
-	"github.com/vivint/infectious"
+	"github.com/jtolds/eestream/cmd/internal/passphrase"
 )
 
 var (
-	pieceBlockSize = flag.Int("piece_block_size", 4*1024, "block size of pieces")
-	key            = flag.String("key", "a key", "the secret key")
-	rsk            = flag.Int("required", 20, "rs required")
-	rsn            = flag.Int("total", 40, "rs total")
+	pipeline = flag.String("pipeline", "pad,secretbox,rs:20/40@4096",
+		"the stages to encode with; rs:<required>/<total>@<piece block size> "+
+			"must come last")
+	workers = flag.Int("workers", runtime.NumCPU(),
+		"number of blocks to erasure code in parallel")
+	merkleBlockSize = flag.Int("merkle_block_size", 0,
+		"block size of the merkle tree that cmd/serve checks reads with; "+
+			"defaults to the plaintext in one block of a piece, so small "+
+			"reads touch as few pieces as possible")
+	name = flag.String("name", "",
+		"the file name cmd/serve gives the data; defaults to the target "+
+			"directory's name")
+	contentType = flag.String("content_type", "",
+		"the content type cmd/serve gives the data; guessed from the name "+
+			"and data if empty")
+	recipients recipientsFlag
 )
 
+func init() {
+	flag.Var(&recipients, "recipient", "a public key from cmd/keygen that "+
+		"can also decrypt the data; may be repeated")
+}
+
+// recipientsFlag is a flag.Value that collects every -recipient.
+type recipientsFlag []eestream.PublicKey
+
+func (r *recipientsFlag) String() string {
+	return fmt.Sprintf("%d recipients", len(*r))
+}
+
+func (r *recipientsFlag) Set(s string) error {
+	var pub eestream.PublicKey
+	err := pub.UnmarshalText([]byte(s))
+	if err != nil {
+		return err
+	}
+	*r = append(*r, pub)
+	return nil
+}
+
 func main() {
 	flag.Parse()
 	if flag.Arg(0) == "" {
@@ -34,35 +71,124 @@ func main() {
 	}
 }
 
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// newDataKey returns a random key to encrypt the data with, wrapped with the
+// passphrase and for every recipient. Only the data key is encrypted with
+// the passphrase, so cmd/rekey can change the passphrase without touching
+// the data.
+func newDataKey() (dataKey []byte, salt eestream.KeySalt,
+	wrappedKeys []eestream.WrappedKey, err error) {
+	pass, err := passphrase.Read(true)
+	if err != nil {
+		return nil, salt, nil, err
+	}
+	salt, err = eestream.NewKeySalt()
+	if err != nil {
+		return nil, salt, nil, err
+	}
+	kek, err := eestream.PassphraseKey(pass, salt)
+	if err != nil {
+		return nil, salt, nil, err
+	}
+	dataKey, err = eestream.NewDataKey()
+	if err != nil {
+		return nil, salt, nil, err
+	}
+	wrapped, err := eestream.WrapKey(kek, dataKey)
+	if err != nil {
+		return nil, salt, nil, err
+	}
+	wrappedKeys = []eestream.WrappedKey{wrapped}
+	for _, recipient := range recipients {
+		wrapped, err := eestream.WrapKeyForRecipient(recipient, dataKey)
+		if err != nil {
+			return nil, salt, nil, err
+		}
+		wrappedKeys = append(wrappedKeys, wrapped)
+	}
+	return dataKey, salt, wrappedKeys, nil
+}
+
 func Main() error {
 	err := os.MkdirAll(flag.Arg(0), 0755)
 	if err != nil {
 		return err
 	}
-	fc, err := infectious.NewFEC(*rsk, *rsn)
+	config, err := eestream.ParsePipelineSpec(*pipeline)
 	if err != nil {
 		return err
 	}
-	es := eestream.NewRSScheme(fc, *pieceBlockSize)
-	encKey := sha256.Sum256([]byte(*key))
-	encrypter, err := eestream.NewSecretboxEncrypter(encKey[:],
-		es.DecodedBlockSize())
+	var dataKey []byte
+	var salt eestream.KeySalt
+	var wrappedKeys []eestream.WrappedKey
+	if config.Cipher != "" {
+		dataKey, salt, wrappedKeys, err = newDataKey()
+		if err != nil {
+			return err
+		}
+	}
+	prefix, err := eestream.NewNoncePrefix()
 	if err != nil {
 		return err
 	}
-	readers := eestream.EncodeReader(eestream.TransformReader(
-		eestream.PadReader(os.Stdin, encrypter.InBlockSize()), encrypter, 0), es)
+	p, err := eestream.NewPipeline(config, dataKey, prefix)
+	if err != nil {
+		return err
+	}
+	if *merkleBlockSize <= 0 {
+		*merkleBlockSize = p.BlockSize()
+	}
+	hasher := eestream.NewMerkleHasher(*merkleBlockSize)
+	input := &countingReader{r: io.TeeReader(os.Stdin, hasher)}
+	readers := p.EncodeReader(context.Background(), input,
+		eestream.EncoderOptions{Workers: *workers, Lookahead: 2 * *workers})
+	// the plaintext size isn't known until all of the input has been read, so
+	// it gets filled in once the pieces are written.
+	header, err := p.PieceHeader(-1)
+	if err != nil {
+		return err
+	}
+	header.KeySalt = salt
+	header.WrappedKeys = wrappedKeys
+	header.MerkleBlockSize = *merkleBlockSize
+	header.Name = *name
+	if header.Name == "" {
+		header.Name = filepath.Base(flag.Arg(0))
+	}
+	header.ContentType = *contentType
+	header.ModTime = time.Now()
+	readers, err = eestream.AddPieceHeaders(readers, *header)
+	if err != nil {
+		return err
+	}
+	files := make([]*os.File, 0, len(readers))
+	defer func() {
+		for _, fh := range files {
+			fh.Close()
+		}
+	}()
+	for i := range readers {
+		fh, err := os.Create(
+			filepath.Join(flag.Arg(0), fmt.Sprintf("%d.piece", i)))
+		if err != nil {
+			return err
+		}
+		files = append(files, fh)
+	}
 	errs := make(chan error, len(readers))
 	for i := range readers {
 		go func(i int) {
-			fh, err := os.Create(
-				filepath.Join(flag.Arg(0), fmt.Sprintf("%d.piece", i)))
-			if err != nil {
-				errs <- err
-				return
-			}
-			defer fh.Close()
-			_, err = io.Copy(fh, readers[i])
+			_, err := io.Copy(files[i], readers[i])
 			errs <- err
 		}(i)
 	}
@@ -72,5 +198,37 @@ func Main() error {
 			return err
 		}
 	}
+	tree := hasher.Tree()
+	treeData, err := tree.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(flag.Arg(0), "merkle.tree"), treeData,
+		0644)
+	if err != nil {
+		return err
+	}
+	// the rest of the manifest is the same size however big the input was,
+	// so the headers can be rewritten in place.
+	manifest, err := p.Manifest(input.n)
+	if err != nil {
+		return err
+	}
+	header.PlaintextSize = manifest.PlaintextSize
+	header.Padding = manifest.Padding
+	header.MerkleRoot = tree.Root()
+	for i, fh := range files {
+		header.PieceNum = i
+		buf, err := header.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		_, err = fh.WriteAt(buf, 0)
+		if err != nil {
+			return err
+		}
+	}
+	// the root is what cmd/serve -root needs to know the data is intact.
+	fmt.Printf("merkle root: %x\n", header.MerkleRoot)
 	return nil
 }
@@ -0,0 +1,129 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/jtolds/eestream/ranger"
+	"github.com/vivint/infectious"
+)
+
+func TestEncodeReaderContext(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 1024)
+	data := randData(rs.DecodedBlockSize() * 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	readers := EncodeReaderContext(ctx, bytes.NewReader(data), rs,
+		EncoderOptions{})
+
+	// piece 0 gets ahead of the other pieces and has to wait for them, until
+	// the context is canceled.
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = ioutil.ReadAll(readers[0])
+	if err != context.Canceled {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+	_, err = readers[1].Read(make([]byte, 1))
+	if err != context.Canceled {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+}
+
+func TestEncodeReaderContextLeaks(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 64)
+	data := randData(rs.DecodedBlockSize() * 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	before := runtime.NumGoroutine()
+
+	// the pieces wait on each other, but once they stop being read partway
+	// through, nothing is left running, even though ctx isn't done.
+	readers := EncodeReaderContext(ctx, bytes.NewReader(data), rs,
+		EncoderOptions{})
+	errs := make(chan error, len(readers))
+	for _, r := range readers {
+		go func(r io.Reader) {
+			_, err := io.CopyN(ioutil.Discard, r,
+				int64(rs.EncodedBlockSize()*3))
+			errs <- err
+		}(r)
+	}
+	for range readers {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkGoroutines(t, "dropped encode", before)
+}
+
+func TestDecodeReadersContext(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 1024)
+	pieces := encodePieces(t, randData(rs.DecodedBlockSize()*4), rs)
+
+	for _, opts := range []DecoderOptions{{}, {SkipLongTail: true}} {
+		stuck := make(chan struct{})
+		readerMap := map[int]io.Reader{}
+		for i, piece := range pieces {
+			readerMap[i] = &stuckReader{
+				r: bytes.NewReader(piece), release: stuck}
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		_, err = ioutil.ReadAll(DecodeReadersContext(ctx, readerMap, rs, opts))
+		close(stuck)
+		if err != context.Canceled {
+			t.Fatalf("expected canceled, got %v", err)
+		}
+	}
+}
+
+func TestDecodeRangeContext(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 1024)
+	pieces := encodePieces(t, randData(rs.DecodedBlockSize()*4), rs)
+	rrs := map[int]ranger.Ranger{}
+	for i, piece := range pieces {
+		rrs[i] = ranger.ByteRanger(piece)
+	}
+	rr, err := Decode(rrs, rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err = Transform(rr, &pieceEncoder{es: rs, num: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := ranger.RangeContext(ctx, rr, 0, rr.Size())
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	_, err = ioutil.ReadAll(r)
+	if err != context.Canceled {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+}
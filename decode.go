@@ -4,78 +4,299 @@
 package eestream
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
+	"strings"
 
 	"github.com/jtolds/eestream/ranger"
 )
 
 type decodedReader struct {
+	ctx    context.Context
 	rs     map[int]io.Reader
 	es     ErasureScheme
+	opts   DecoderOptions
 	inbufs map[int][]byte
-	outbuf []byte
-	err    error
+	// block holds the decoded block, and outbuf is what's left of it to
+	// read.
+	block    []byte
+	outbuf   []byte
+	failed   map[int]error
+	workers  map[int]*pieceWorker
+	results  chan pieceResult
+	closers  []io.Closer
+	blockNum int64
+	endBlock int64
+	err      error
+}
+
+// DecoderOptions configure how DecodeReadersWithOptions and DecodeWithOptions
+// read from pieces.
+type DecoderOptions struct {
+	// SkipLongTail, if true, decodes each block as soon as RequiredCount
+	// pieces have delivered it, instead of waiting on every piece. Pieces
+	// that are still busy with an earlier block are skipped for the current
+	// one, and catch up in the background by discarding what they read.
+	SkipLongTail bool
+
+	// CorruptPieces, if not nil, is called with the block number and the
+	// numbers of the pieces whenever decoding a block finds and corrects
+	// corrupt pieces. Block numbers count erasure coded blocks from the start
+	// of the pieces. It is only called if the ErasureScheme is a
+	// CorruptionDetector, and never with SkipLongTail, which only decodes
+	// from RequiredCount pieces and so has no spare pieces to find the
+	// corrupt ones with.
+	CorruptPieces func(blockNum int64, pieces []int)
+
+	// ReadAhead is the number of blocks to fetch and decode on a background
+	// goroutine ahead of the reader, so large sequential reads aren't held
+	// up waiting on each block in turn. Up to ReadAhead+1 extra decoded
+	// blocks are kept in memory. A reader that is abandoned before it ends
+	// keeps its goroutine until it is closed or its context is done. Values
+	// less than 1 mean no read ahead.
+	ReadAhead int
+}
+
+// A CorruptionDetector is an ErasureScheme that can tell which pieces it had
+// to correct while decoding.
+type CorruptionDetector interface {
+	ErasureScheme
+
+	// DecodeAndDetect is like Decode, but also returns the numbers of the
+	// pieces in 'in' that were found to be corrupt.
+	DecodeAndDetect(out []byte, in map[int][]byte) (
+		data []byte, corrupt []int, err error)
+}
+
+// A SystematicScheme is an ErasureScheme whose first RequiredCount pieces
+// hold the decoded data verbatim: piece i holds bytes
+// [i*EncodedBlockSize(), (i+1)*EncodedBlockSize()) of every decoded block.
+// Ranges of such data can be read from just the pieces that cover them.
+type SystematicScheme interface {
+	ErasureScheme
+
+	// Systematic returns true if the pieces hold the data verbatim.
+	Systematic() bool
 }
 
 // DecodeReaders takes a map of readers and an ErasureScheme returning a
 // combined Reader. The map, 'rs', must be a mapping of erasure piece numbers
-// to erasure piece streams.
-func DecodeReaders(rs map[int]io.Reader, es ErasureScheme) io.Reader {
+// to erasure piece streams. Pieces that fail are dropped for the rest of the
+// stream, and decoding continues as long as at least es.RequiredCount()
+// pieces remain. Once too few remain, Read returns a *PieceErrors.
+//
+// Every piece is read by a long-lived worker goroutine. The workers exit once
+// the stream ends or fails, when the returned Reader is closed, or after
+// they've been idle for a while. Close also closes any of the readers in rs
+// that are io.Closers, which is the only way to stop a worker stuck reading
+// from a piece that never responds.
+func DecodeReaders(rs map[int]io.Reader, es ErasureScheme) io.ReadCloser {
+	return DecodeReadersWithOptions(rs, es, DecoderOptions{})
+}
+
+// DecodeReadersWithOptions is like DecodeReaders but configured by opts.
+func DecodeReadersWithOptions(rs map[int]io.Reader, es ErasureScheme,
+	opts DecoderOptions) io.ReadCloser {
+	return DecodeReadersContext(context.Background(), rs, es, opts)
+}
+
+// DecodeReadersContext is like DecodeReadersWithOptions, but stops with
+// ctx.Err() once ctx is done. Reads from pieces that are already in progress
+// are abandoned rather than waited on.
+func DecodeReadersContext(ctx context.Context, rs map[int]io.Reader,
+	es ErasureScheme, opts DecoderOptions) io.ReadCloser {
+	ctx, cancel := context.WithCancel(ctx)
+	return readAhead(ctx, cancel, decodeReaders(ctx, rs, es, opts, 0, -1),
+		es.DecodedBlockSize(), opts.ReadAhead)
+}
+
+// decodeReaders is like DecodeReadersContext, but for pieces that start at
+// block firstBlock, and end before block endBlock, or -1 if that isn't known.
+func decodeReaders(ctx context.Context, rs map[int]io.Reader,
+	es ErasureScheme, opts DecoderOptions,
+	firstBlock, endBlock int64) *decodedReader {
 	dr := &decodedReader{
-		rs:     rs,
-		es:     es,
-		inbufs: make(map[int][]byte, len(rs)),
-		outbuf: make([]byte, 0, es.DecodedBlockSize()),
+		ctx:      ctx,
+		rs:       make(map[int]io.Reader, len(rs)),
+		es:       es,
+		opts:     opts,
+		inbufs:   make(map[int][]byte, len(rs)),
+		block:    getBlock(es.DecodedBlockSize()),
+		failed:   map[int]error{},
+		blockNum: firstBlock,
+		endBlock: endBlock,
 	}
-	for i := range rs {
-		dr.inbufs[i] = make([]byte, es.EncodedBlockSize())
+	for i, r := range rs {
+		dr.rs[i] = r
+		dr.inbufs[i] = getBlock(es.EncodedBlockSize())
+		if c, ok := r.(io.Closer); ok {
+			dr.closers = append(dr.closers, c)
+		}
 	}
+	dr.workers, dr.results = startWorkers(dr.rs, dr.inbufs, firstBlock)
 	return dr
 }
 
+// PieceErrors is returned when a decode can't continue because fewer than
+// Required pieces are still healthy. Failed maps the number of every piece
+// that was dropped to the error that caused it.
+//
+// Unlike the package's other errors, PieceErrors isn't part of the Error
+// class, since wrapping it would hide Failed from callers. Check for it with
+// a type assertion instead of Error.Contains.
+type PieceErrors struct {
+	Required int
+	Failed   map[int]error
+}
+
+func (e *PieceErrors) Error() string {
+	nums := make([]int, 0, len(e.Failed))
+	for num := range e.Failed {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	msgs := make([]string, 0, len(nums))
+	for _, num := range nums {
+		msgs = append(msgs, fmt.Sprintf("piece %d: %v", num, e.Failed[num]))
+	}
+	return fmt.Sprintf("not enough healthy pieces, %d required: %s",
+		e.Required, strings.Join(msgs, "; "))
+}
+
+type pieceResult struct {
+	num int
+	err error
+}
+
+// readBlock reads the next block from every remaining piece, dropping the
+// pieces that fail. readBlock returns io.EOF if every remaining piece ended
+// cleanly on a block boundary.
+func (dr *decodedReader) readBlock() error {
+	if dr.opts.SkipLongTail {
+		return dr.readFastest()
+	}
+	eofs, failed, err := readAll(dr.ctx, dr.workers, dr.results)
+	if err != nil {
+		return err
+	}
+	for i, err := range failed {
+		dr.fail(i, err)
+	}
+	if len(eofs) > 0 && len(eofs) == len(dr.rs) {
+		return io.EOF
+	}
+	// if some pieces ended but others didn't, the ones that ended were cut
+	// short.
+	for i := range eofs {
+		dr.fail(i, io.ErrUnexpectedEOF)
+	}
+	if len(dr.rs) < dr.es.RequiredCount() {
+		return &PieceErrors{Required: dr.es.RequiredCount(), Failed: dr.failed}
+	}
+	return nil
+}
+
+func (dr *decodedReader) fail(num int, err error) {
+	dr.failed[num] = err
+	delete(dr.rs, num)
+	delete(dr.inbufs, num)
+	if w, ok := dr.workers[num]; ok {
+		w.stop()
+		delete(dr.workers, num)
+	}
+}
+
+// stopWorkers lets every worker goroutine exit once it is done with its
+// current read. The buffers of the workers that aren't reading go back to
+// the pool.
+func (dr *decodedReader) stopWorkers() {
+	for _, w := range dr.workers {
+		if !w.busy {
+			putBlock(w.buf)
+		}
+	}
+	stopWorkers(dr.workers)
+	dr.inbufs = nil
+}
+
+func (dr *decodedReader) decodeBlock() ([]byte, error) {
+	cd, ok := dr.es.(CorruptionDetector)
+	if !ok || dr.opts.CorruptPieces == nil {
+		return dr.es.Decode(dr.block[:0], dr.inbufs)
+	}
+	out, corrupt, err := cd.DecodeAndDetect(dr.block[:0], dr.inbufs)
+	if err == nil && len(corrupt) > 0 {
+		dr.opts.CorruptPieces(dr.blockNum, corrupt)
+	}
+	return out, err
+}
+
 func (dr *decodedReader) Read(p []byte) (n int, err error) {
+	if err := dr.ctx.Err(); err != nil {
+		dr.stopWorkers()
+		return 0, err
+	}
 	if len(dr.outbuf) <= 0 {
 		if dr.err != nil {
-			return 0, err
+			putBlock(dr.block)
+			dr.block = nil
+			return 0, dr.err
 		}
-		errs := make(chan error, len(dr.rs))
-		for i := range dr.rs {
-			go func(i int) {
-				_, err := io.ReadFull(dr.rs[i], dr.inbufs[i])
-				errs <- err
-			}(i)
-		}
-		for range dr.rs {
-			err := <-errs
-			if err != nil {
-				dr.err = err
-				return 0, err
-			}
+		err = dr.readBlock()
+		if err == nil {
+			dr.outbuf, err = dr.decodeBlock()
 		}
-		dr.outbuf, err = dr.es.Decode(dr.outbuf, dr.inbufs)
 		if err != nil {
+			dr.err = err
+			dr.stopWorkers()
 			return 0, err
 		}
+		dr.blockNum++
+		if dr.blockNum == dr.endBlock {
+			// there's nothing left for the workers to read.
+			dr.err = io.EOF
+			dr.stopWorkers()
+		}
 	}
 
 	n = copy(p, dr.outbuf)
-	copy(dr.outbuf, dr.outbuf[n:])
-	dr.outbuf = dr.outbuf[:len(dr.outbuf)-n]
+	dr.outbuf = dr.outbuf[n:]
 	return n, nil
 }
 
+// Close stops the workers and closes the pieces that are io.Closers.
+func (dr *decodedReader) Close() error {
+	dr.stopWorkers()
+	putBlock(dr.block)
+	dr.block, dr.outbuf = nil, nil
+	if dr.err == nil || dr.err == io.EOF {
+		dr.err = Error.New("decoder closed")
+	}
+	return closeAll(&dr.closers)
+}
+
 type decodedRanger struct {
 	es     ErasureScheme
 	rrs    map[int]ranger.Ranger
+	opts   DecoderOptions
 	inSize int64
 }
 
 // Decode takes a map of Rangers and an ErasureSchema and returns a combined
 // Ranger. The map, 'rrs', must be a mapping of erasure piece numbers
-// to erasure piece rangers.
+// to erasure piece rangers. The Readers the Ranger returns are
+// io.ReadClosers, and should be closed if they aren't read to the end.
 func Decode(rrs map[int]ranger.Ranger, es ErasureScheme) (
 	ranger.Ranger, error) {
+	return DecodeWithOptions(rrs, es, DecoderOptions{})
+}
+
+// DecodeWithOptions is like Decode but configured by opts.
+func DecodeWithOptions(rrs map[int]ranger.Ranger, es ErasureScheme,
+	opts DecoderOptions) (ranger.Ranger, error) {
 	size := int64(-1)
 	for _, rr := range rrs {
 		if size == -1 {
@@ -100,6 +321,7 @@ func Decode(rrs map[int]ranger.Ranger, es ErasureScheme) (
 	return &decodedRanger{
 		es:     es,
 		rrs:    rrs,
+		opts:   opts,
 		inSize: size,
 	}, nil
 }
@@ -110,20 +332,228 @@ func (dr *decodedRanger) Size() int64 {
 }
 
 func (dr *decodedRanger) Range(offset, length int64) io.Reader {
+	return dr.RangeContext(context.Background(), offset, length)
+}
+
+func (dr *decodedRanger) RangeContext(ctx context.Context,
+	offset, length int64) io.Reader {
 	firstBlock, blockCount := calcEncompassingBlocks(
 		offset, length, dr.es.DecodedBlockSize())
 
-	readers := make(map[int]io.Reader, len(dr.rrs))
-	for i, rr := range dr.rrs {
-		readers[i] = rr.Range(
-			firstBlock*int64(dr.es.EncodedBlockSize()),
-			blockCount*int64(dr.es.EncodedBlockSize()))
+	ctx, cancel := context.WithCancel(ctx)
+	var r io.ReadCloser
+	if needed := dr.dataPieces(offset, length); needed != nil {
+		r = dr.stitchBlocks(ctx, firstBlock, blockCount, needed)
+	} else {
+		r = dr.decodeBlocks(ctx, firstBlock, blockCount, nil)
+	}
+	readAheadCount := dr.opts.ReadAhead
+	if blockCount <= 1 {
+		readAheadCount = 0
 	}
-	r := DecodeReaders(readers, dr.es)
+	r = readAhead(ctx, cancel, r, dr.es.DecodedBlockSize(), readAheadCount)
 	_, err := io.CopyN(ioutil.Discard, r,
 		offset-firstBlock*int64(dr.es.DecodedBlockSize()))
 	if err != nil {
+		r.Close()
 		return ranger.FatalReader(Error.Wrap(err))
 	}
-	return io.LimitReader(r, length)
+	return readCloser{Reader: io.LimitReader(r, length), Closer: r}
+}
+
+// readCloser is a Reader that is closed by a different Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decodeBlocks returns a Reader of blockCount decoded blocks starting at
+// firstBlock, erasure decoded from every piece but the ones that already
+// failed.
+func (dr *decodedRanger) decodeBlocks(ctx context.Context,
+	firstBlock, blockCount int64, failed map[int]error) io.ReadCloser {
+	readers := make(map[int]io.Reader, len(dr.rrs))
+	for i, rr := range dr.rrs {
+		if failed[i] == nil {
+			readers[i] = dr.pieceRange(ctx, rr, firstBlock, blockCount)
+		}
+	}
+	if len(readers) < dr.es.RequiredCount() {
+		return ioutil.NopCloser(ranger.FatalReader(&PieceErrors{
+			Required: dr.es.RequiredCount(), Failed: failed}))
+	}
+	r := decodeReaders(ctx, readers, dr.es, dr.opts, firstBlock,
+		firstBlock+blockCount)
+	for i, err := range failed {
+		r.failed[i] = err
+	}
+	return r
+}
+
+func (dr *decodedRanger) pieceRange(ctx context.Context, rr ranger.Ranger,
+	firstBlock, blockCount int64) io.Reader {
+	return ranger.RangeContext(ctx, rr,
+		firstBlock*int64(dr.es.EncodedBlockSize()),
+		blockCount*int64(dr.es.EncodedBlockSize()))
+}
+
+// dataPieces returns which of the first RequiredCount pieces hold the bytes
+// from offset to offset+length, if the ErasureScheme is systematic and all
+// of those pieces are available. Otherwise it returns nil, and the range has
+// to be erasure decoded.
+func (dr *decodedRanger) dataPieces(offset, length int64) []bool {
+	ss, ok := dr.es.(SystematicScheme)
+	// corrupt pieces can only be found by decoding with the parity pieces.
+	if !ok || !ss.Systematic() || dr.opts.CorruptPieces != nil ||
+		length <= 0 {
+		return nil
+	}
+	blockSize := int64(dr.es.DecodedBlockSize())
+	pieceSize := int64(dr.es.EncodedBlockSize())
+	needed := make([]bool, dr.es.RequiredCount())
+	mark := func(first, last int64) {
+		for i := first / pieceSize; i <= last/pieceSize; i++ {
+			needed[i] = true
+		}
+	}
+	end := offset + length - 1
+	switch end/blockSize - offset/blockSize {
+	case 0:
+		mark(offset%blockSize, end%blockSize)
+	case 1:
+		mark(offset%blockSize, blockSize-1)
+		mark(0, end%blockSize)
+	default:
+		mark(0, blockSize-1)
+	}
+	for i, need := range needed {
+		if _, ok := dr.rrs[i]; need && !ok {
+			return nil
+		}
+	}
+	return needed
+}
+
+// stitchBlocks is like decodeBlocks, but only reads the needed data pieces
+// and puts the blocks together from them directly. The parts of a block in
+// pieces that aren't needed are left zeroed. If a needed piece fails, the
+// rest of the blocks are erasure decoded from the other pieces instead.
+func (dr *decodedRanger) stitchBlocks(ctx context.Context,
+	firstBlock, blockCount int64, needed []bool) io.ReadCloser {
+	pieceSize := dr.es.EncodedBlockSize()
+	sr := &stitchedReader{
+		ctx:      ctx,
+		dr:       dr,
+		block:    getBlock(dr.es.DecodedBlockSize()),
+		blockNum: firstBlock,
+		endBlock: firstBlock + blockCount,
+	}
+	readers := make(map[int]io.Reader, len(needed))
+	bufs := make(map[int][]byte, len(needed))
+	for i, need := range needed {
+		buf := sr.block[i*pieceSize : (i+1)*pieceSize]
+		if !need {
+			// the block is pooled, so it may hold another stream's data.
+			for j := range buf {
+				buf[j] = 0
+			}
+			continue
+		}
+		readers[i] = dr.pieceRange(ctx, dr.rrs[i], firstBlock, blockCount)
+		bufs[i] = buf
+		if c, ok := readers[i].(io.Closer); ok {
+			sr.closers = append(sr.closers, c)
+		}
+	}
+	sr.workers, sr.results = startWorkers(readers, bufs, firstBlock)
+	return sr
+}
+
+type stitchedReader struct {
+	ctx      context.Context
+	dr       *decodedRanger
+	workers  map[int]*pieceWorker
+	results  chan pieceResult
+	closers  []io.Closer
+	block    []byte
+	outbuf   []byte
+	blockNum int64
+	endBlock int64
+	fallback io.ReadCloser
+	err      error
+}
+
+// readBlock reads the next block from the needed pieces, returning the
+// pieces that failed.
+func (sr *stitchedReader) readBlock() (failed map[int]error, err error) {
+	eofs, failed, err := readAll(sr.ctx, sr.workers, sr.results)
+	if err != nil {
+		return nil, err
+	}
+	// the pieces are all the same size, so they can't end before the range
+	// does.
+	for i := range eofs {
+		failed[i] = io.ErrUnexpectedEOF
+	}
+	return failed, nil
+}
+
+func (sr *stitchedReader) Read(p []byte) (n int, err error) {
+	if sr.fallback != nil {
+		return sr.fallback.Read(p)
+	}
+	if len(sr.outbuf) <= 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		if sr.blockNum >= sr.endBlock {
+			sr.err = io.EOF
+			sr.release()
+			return 0, io.EOF
+		}
+		failed, err := sr.readBlock()
+		if err != nil {
+			// reads may still be writing to the block, so it can't be reused.
+			sr.err = err
+			sr.block = nil
+			stopWorkers(sr.workers)
+			return 0, err
+		}
+		if len(failed) > 0 {
+			sr.release()
+			closeAll(&sr.closers)
+			sr.fallback = sr.dr.decodeBlocks(sr.ctx, sr.blockNum,
+				sr.endBlock-sr.blockNum, failed)
+			return sr.fallback.Read(p)
+		}
+		sr.outbuf = sr.block
+		sr.blockNum++
+		if sr.blockNum >= sr.endBlock {
+			stopWorkers(sr.workers)
+		}
+	}
+	n = copy(p, sr.outbuf)
+	sr.outbuf = sr.outbuf[n:]
+	return n, nil
+}
+
+// release stops the workers and returns the block to the pool.
+func (sr *stitchedReader) release() {
+	stopWorkers(sr.workers)
+	putBlock(sr.block)
+	sr.block, sr.outbuf = nil, nil
+}
+
+// Close stops the workers and closes the pieces that are io.Closers.
+func (sr *stitchedReader) Close() error {
+	sr.release()
+	if sr.err == nil {
+		sr.err = Error.New("decoder closed")
+	}
+	err := closeAll(&sr.closers)
+	if sr.fallback != nil {
+		err = sr.fallback.Close()
+		sr.fallback = nil
+	}
+	return err
 }
@@ -0,0 +1,249 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jtolds/eestream/ranger"
+	"github.com/vivint/infectious"
+)
+
+var errBadDisk = errors.New("bad disk")
+
+// encodePieces erasure codes data with es and returns every piece.
+func encodePieces(t *testing.T, data []byte, es ErasureScheme) [][]byte {
+	readers := EncodeReaderWithOptions(bytes.NewReader(data), es,
+		EncoderOptions{Lookahead: len(data)/es.DecodedBlockSize() + 1})
+	pieces := make([][]byte, 0, len(readers))
+	for _, r := range readers {
+		piece, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pieces = append(pieces, piece)
+	}
+	return pieces
+}
+
+func TestDecodeDropsFailedPieces(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 1024)
+	data := randData(rs.DecodedBlockSize() * 4)
+	pieces := encodePieces(t, data, rs)
+
+	readerMap := map[int]io.Reader{
+		// fails partway through the second block
+		0: io.MultiReader(bytes.NewReader(pieces[0][:1500]),
+			&errReader{err: errBadDisk}),
+		// ends early on a block boundary
+		1: bytes.NewReader(pieces[1][:2048]),
+		2: bytes.NewReader(pieces[2]),
+		3: bytes.NewReader(pieces[3]),
+		4: &errReader{err: errBadDisk},
+	}
+	data2, err := ioutil.ReadAll(DecodeReaders(readerMap, rs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Fatalf("decode with failed pieces failed")
+	}
+}
+
+func TestDecodeNotEnoughPieces(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 1024)
+	data := randData(rs.DecodedBlockSize() * 4)
+	pieces := encodePieces(t, data, rs)
+
+	readerMap := map[int]io.Reader{
+		0: bytes.NewReader(pieces[0]),
+		1: bytes.NewReader(pieces[1][:1024]),
+		3: &errReader{err: errBadDisk},
+	}
+	_, err = ioutil.ReadAll(DecodeReaders(readerMap, rs))
+	perr, ok := err.(*PieceErrors)
+	if !ok {
+		t.Fatalf("expected *PieceErrors, got %v", err)
+	}
+	if len(perr.Failed) != 2 || perr.Failed[1] != io.ErrUnexpectedEOF ||
+		perr.Failed[3] != errBadDisk {
+		t.Fatalf("unexpected failed pieces: %v", perr)
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read(p []byte) (n int, err error) {
+	return 0, e.err
+}
+
+func TestDecodeSkipLongTail(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 1024)
+	data := randData(rs.DecodedBlockSize() * 4)
+	pieces := encodePieces(t, data, rs)
+
+	// piece 3 doesn't respond until the whole stream has been decoded.
+	stuck := make(chan struct{})
+	defer close(stuck)
+	readerMap := map[int]io.Reader{
+		0: bytes.NewReader(pieces[0]),
+		1: bytes.NewReader(pieces[1]),
+		2: bytes.NewReader(pieces[2]),
+		3: &stuckReader{r: bytes.NewReader(pieces[3]), release: stuck},
+	}
+	data2, err := ioutil.ReadAll(DecodeReadersWithOptions(readerMap, rs,
+		DecoderOptions{SkipLongTail: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Fatalf("decode skipping long tail failed")
+	}
+}
+
+type stuckReader struct {
+	r       io.Reader
+	release chan struct{}
+}
+
+func (s *stuckReader) Read(p []byte) (n int, err error) {
+	<-s.release
+	return s.r.Read(p)
+}
+
+// touchedRanger records whether it was read from.
+type touchedRanger struct {
+	ranger.Ranger
+	touched bool
+}
+
+func (t *touchedRanger) Range(offset, length int64) io.Reader {
+	t.touched = true
+	return t.Ranger.Range(offset, length)
+}
+
+func TestDecodeSystematic(t *testing.T) {
+	fc, err := infectious.NewFEC(4, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 64)
+	data := randData(rs.DecodedBlockSize() * 5)
+	pieces := encodePieces(t, data, rs)
+
+	for _, test := range []struct {
+		offset, length int64
+		missing        int
+		touched        []int
+	}{
+		// inside one block of one piece
+		{offset: 256*2 + 64 + 10, length: 20, missing: -1, touched: []int{1}},
+		// across pieces within a block
+		{offset: 256 + 60, length: 70, missing: -1, touched: []int{0, 1, 2}},
+		// across a block boundary
+		{offset: 256 + 250, length: 12, missing: -1, touched: []int{0, 3}},
+		{offset: 0, length: 256 * 5, missing: -1, touched: []int{0, 1, 2, 3}},
+		// a missing data piece means decoding with every piece
+		{offset: 256*2 + 64 + 10, length: 20, missing: 1,
+			touched: []int{0, 2, 3, 4, 5, 6, 7}},
+		// a piece that isn't needed doesn't matter
+		{offset: 256*2 + 64 + 10, length: 20, missing: 2, touched: []int{1}},
+	} {
+		rrs := map[int]ranger.Ranger{}
+		for i, piece := range pieces {
+			if i != test.missing {
+				rrs[i] = &touchedRanger{Ranger: ranger.ByteRanger(piece)}
+			}
+		}
+		rr, err := Decode(rrs, rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rr.Range(test.offset, test.length))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data[test.offset:test.offset+test.length]) {
+			t.Fatalf("%d+%d: wrong data", test.offset, test.length)
+		}
+		var touched []int
+		for i := range pieces {
+			if rrs[i] != nil && rrs[i].(*touchedRanger).touched {
+				touched = append(touched, i)
+			}
+		}
+		if fmt.Sprint(touched) != fmt.Sprint(test.touched) {
+			t.Fatalf("%d+%d: read pieces %v, expected %v", test.offset,
+				test.length, touched, test.touched)
+		}
+	}
+}
+
+func TestDecodeSystematicFallback(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 64)
+	data := randData(rs.DecodedBlockSize() * 4)
+	pieces := encodePieces(t, data, rs)
+
+	// piece 1 fails partway through the third block
+	rrs := map[int]ranger.Ranger{
+		0: ranger.ByteRanger(pieces[0]),
+		1: &failingRanger{ByteRanger: pieces[1], failAt: 64*2 + 10},
+		2: ranger.ByteRanger(pieces[2]),
+		3: ranger.ByteRanger(pieces[3]),
+	}
+	rr := &decodedRanger{es: rs, rrs: rrs, inSize: int64(len(pieces[0]))}
+	got, err := ioutil.ReadAll(rr.Range(10, rr.Size()-20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[10:len(data)-10]) {
+		t.Fatalf("fallback to parity pieces failed")
+	}
+
+	// without enough other pieces, the failure is reported
+	delete(rrs, 2)
+	delete(rrs, 3)
+	_, err = ioutil.ReadAll(rr.Range(10, rr.Size()-20))
+	perr, ok := err.(*PieceErrors)
+	if !ok || perr.Failed[1] != errBadDisk {
+		t.Fatalf("expected piece 1 to fail, got %v", err)
+	}
+}
+
+// failingRanger fails reads that go past failAt.
+type failingRanger struct {
+	ranger.ByteRanger
+	failAt int64
+}
+
+func (f *failingRanger) Range(offset, length int64) io.Reader {
+	if offset+length <= f.failAt {
+		return f.ByteRanger.Range(offset, length)
+	}
+	return io.MultiReader(f.ByteRanger.Range(offset, f.failAt-offset),
+		&errReader{err: errBadDisk})
+}
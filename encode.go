@@ -4,6 +4,7 @@
 package eestream
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"sync"
@@ -38,85 +39,288 @@ type ErasureScheme interface {
 }
 
 type encodedReader struct {
-	r               io.Reader
-	es              ErasureScheme
-	cv              *sync.Cond
-	inbuf           []byte
-	outbufs         [][]byte
-	piecesRemaining int
-	err             error
+	ctx     context.Context
+	r       io.Reader
+	es      ErasureScheme
+	opts    EncoderOptions
+	cv      *sync.Cond
+	inbufs  [][]byte
+	pieces  []*encodedPiece
+	live    int
+	reading bool
+	err     error
+	// waiting is the number of pieces waiting on cv, and stopWatch stops
+	// the goroutine that watches ctx for them.
+	waiting   int
+	stopWatch chan struct{}
 }
 
+// EncoderOptions configure how the Readers returned from
+// EncodeReaderWithOptions buffer erasure coded data.
+type EncoderOptions struct {
+	// Lookahead is the number of encoded blocks a piece may have buffered
+	// ahead of its Reader. Fast pieces can get this many blocks ahead of the
+	// slowest piece before they wait. Values less than 1 mean 1.
+	Lookahead int
+
+	// AbandonSlowPieces, if true, drops a piece that is too far behind to
+	// buffer more blocks when another piece needs them, instead of waiting
+	// for it.
+	// Further reads from an abandoned piece fail with an AbandonedError. A
+	// piece is never abandoned if that would leave fewer than RequiredCount
+	// pieces.
+	AbandonSlowPieces bool
+
+	// Workers is the number of blocks to read ahead and erasure code
+	// concurrently. The ErasureScheme's Encode method must be safe for
+	// concurrent use if Workers is more than 1. New blocks are only encoded
+	// once every piece has room for Workers more, so Lookahead is raised to
+	// at least Workers, and should be at least twice Workers to keep pieces
+	// busy while the next blocks are encoded. Values less than 1 mean 1.
+	Workers int
+}
+
+// AbandonedError is the class of errors returned by pieces that fell too far
+// behind and were abandoned.
+var AbandonedError = Error.NewClass("piece abandoned")
+
 // EncodeReader will take a Reader and an ErasureScheme and return a slice of
-// Readers
+// Readers. The Readers must be read in lockstep, one block at a time. See
+// EncodeReaderWithOptions for a more flexible alternative.
 func EncodeReader(r io.Reader, es ErasureScheme) []io.Reader {
+	return EncodeReaderWithOptions(r, es, EncoderOptions{})
+}
+
+// EncodeReaderWithOptions is like EncodeReader but allows each returned
+// Reader to run up to opts.Lookahead blocks ahead of the others, and can
+// abandon pieces that fall behind.
+func EncodeReaderWithOptions(r io.Reader, es ErasureScheme,
+	opts EncoderOptions) []io.Reader {
+	return EncodeReaderContext(context.Background(), r, es, opts)
+}
+
+// EncodeReaderContext is like EncodeReaderWithOptions, but the returned
+// Readers stop with ctx.Err() once ctx is done.
+func EncodeReaderContext(ctx context.Context, r io.Reader, es ErasureScheme,
+	opts EncoderOptions) []io.Reader {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.Lookahead < opts.Workers {
+		opts.Lookahead = opts.Workers
+	}
 	er := &encodedReader{
-		r:       r,
-		es:      es,
-		cv:      sync.NewCond(&sync.Mutex{}),
-		inbuf:   make([]byte, es.DecodedBlockSize()),
-		outbufs: make([][]byte, es.TotalCount()),
+		ctx:    ctx,
+		r:      r,
+		es:     es,
+		opts:   opts,
+		cv:     sync.NewCond(&sync.Mutex{}),
+		inbufs: make([][]byte, opts.Workers),
+		pieces: make([]*encodedPiece, 0, es.TotalCount()),
+		live:   es.TotalCount(),
+	}
+	for i := range er.inbufs {
+		er.inbufs[i] = make([]byte, es.DecodedBlockSize())
 	}
 	readers := make([]io.Reader, 0, es.TotalCount())
 	for i := 0; i < es.TotalCount(); i++ {
-		er.outbufs[i] = make([]byte, 0, es.EncodedBlockSize())
-		readers = append(readers, &encodedPiece{
-			er: er,
-			i:  i,
-		})
+		ep := &encodedPiece{er: er, i: i}
+		er.pieces = append(er.pieces, ep)
+		readers = append(readers, ep)
 	}
 	return readers
 }
 
-func (er *encodedReader) wait() error {
-	if er.err != nil {
-		return er.err
-	}
-	if er.piecesRemaining > 0 {
+// wait waits for another piece or the encoding to make progress. wait must
+// be called with the lock held. While any piece is waiting, a goroutine
+// watches ctx to wake them up if it's done. It exits once no pieces are
+// waiting, so Readers that are dropped before they end don't leak it.
+func (er *encodedReader) wait() {
+	if er.ctx.Done() == nil {
 		er.cv.Wait()
-		return er.err
+		return
+	}
+	if er.waiting == 0 {
+		er.stopWatch = make(chan struct{})
+		go er.watch(er.stopWatch)
+	}
+	er.waiting++
+	er.cv.Wait()
+	er.waiting--
+	if er.waiting == 0 {
+		close(er.stopWatch)
 	}
+}
 
-	defer er.cv.Broadcast()
-	_, err := io.ReadFull(er.r, er.inbuf)
-	if err != nil {
+// watch wakes up any waiting pieces if the context is done before stop is
+// closed.
+func (er *encodedReader) watch(stop <-chan struct{}) {
+	select {
+	case <-er.ctx.Done():
+		er.cv.L.Lock()
+		er.setErr(er.ctx.Err())
+		er.cv.L.Unlock()
+		er.cv.Broadcast()
+	case <-stop:
+	}
+}
+
+// setErr ends the encoding with err. setErr must be called with the lock
+// held.
+func (er *encodedReader) setErr(err error) {
+	if er.err == nil {
 		er.err = err
-		return err
 	}
-	err = er.es.Encode(er.inbuf, func(num int, data []byte) {
-		er.outbufs[num] = append(er.outbufs[num], data...)
-	})
+}
+
+// ready returns true if every live piece has room for Workers more blocks,
+// abandoning pieces that don't if allowed. ready must be called with the lock
+// held.
+func (er *encodedReader) ready() bool {
+	for _, ep := range er.pieces {
+		if ep.err != nil ||
+			len(ep.blocks) <= er.opts.Lookahead-er.opts.Workers {
+			continue
+		}
+		if !er.opts.AbandonSlowPieces || er.live <= er.es.RequiredCount() {
+			return false
+		}
+		ep.abandon()
+	}
+	return true
+}
+
+// fill reads and encodes up to Workers blocks into every live piece's
+// buffer. fill must be called with the lock held, but releases it while
+// reading and encoding.
+func (er *encodedReader) fill() {
+	er.reading = true
+	er.cv.L.Unlock()
+	blocks, err := er.encodeBlocks(er.opts.Workers)
+	er.cv.L.Lock()
+	defer er.cv.Broadcast()
+	er.reading = false
+	for _, outbufs := range blocks {
+		for i, ep := range er.pieces {
+			if ep.err == nil {
+				ep.blocks = append(ep.blocks, outbufs[i])
+			} else {
+				putBlock(outbufs[i])
+			}
+		}
+	}
 	if err != nil {
-		er.err = err
-		return err
+		er.setErr(err)
+	}
+}
+
+// encodeBlocks reads up to count blocks and erasure codes them concurrently.
+// It returns the pieces of every block that was successfully encoded, in
+// order, along with the error that stopped it early, if any.
+func (er *encodedReader) encodeBlocks(count int) (
+	blocks [][][]byte, err error) {
+	var n int
+	for n = 0; n < count; n++ {
+		_, err = io.ReadFull(er.r, er.inbufs[n])
+		if err != nil {
+			break
+		}
+	}
+	blocks = make([][][]byte, n)
+	errs := make([]error, n)
+	if n == 1 {
+		blocks[0], errs[0] = er.encodeBlock(er.inbufs[0])
+	} else {
+		var wg sync.WaitGroup
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func(i int) {
+				defer wg.Done()
+				blocks[i], errs[i] = er.encodeBlock(er.inbufs[i])
+			}(i)
+		}
+		wg.Wait()
 	}
-	er.piecesRemaining += er.es.TotalCount()
-	return nil
+	for i := range errs {
+		if errs[i] != nil {
+			for _, dropped := range blocks[i:] {
+				putBlocks(dropped)
+			}
+			return blocks[:i], errs[i]
+		}
+	}
+	return blocks, err
+}
+
+func (er *encodedReader) encodeBlock(inbuf []byte) (
+	outbufs [][]byte, err error) {
+	outbufs = make([][]byte, er.es.TotalCount())
+	err = er.es.Encode(inbuf, func(num int, data []byte) {
+		outbufs[num] = getBlock(len(data))
+		copy(outbufs[num], data)
+	})
+	return outbufs, err
 }
 
 type encodedPiece struct {
-	er *encodedReader
-	i  int
+	er     *encodedReader
+	i      int
+	blocks [][]byte
+	// block is the block being read, and outbuf is what's left of it.
+	block  []byte
+	outbuf []byte
+	err    error
+}
+
+// release returns the piece's blocks to the pool.
+func (ep *encodedPiece) release() {
+	putBlocks(ep.blocks)
+	putBlock(ep.block)
+	ep.blocks, ep.block, ep.outbuf = nil, nil, nil
+}
+
+func (ep *encodedPiece) abandon() {
+	ep.err = AbandonedError.New("piece %d fell %d blocks behind",
+		ep.i, len(ep.blocks))
+	ep.release()
+	ep.er.live--
 }
 
 func (ep *encodedPiece) Read(p []byte) (n int, err error) {
-	ep.er.cv.L.Lock()
-	defer ep.er.cv.L.Unlock()
+	er := ep.er
+	if err := er.ctx.Err(); err != nil {
+		return 0, err
+	}
+	er.cv.L.Lock()
+	defer er.cv.L.Unlock()
 
-	outbufs, i := ep.er.outbufs, ep.i
-	if len(outbufs[i]) <= 0 {
-		err := ep.er.wait()
-		if err != nil {
-			return 0, err
+	for len(ep.outbuf) <= 0 {
+		if ep.err != nil {
+			return 0, ep.err
+		}
+		putBlock(ep.block)
+		ep.block = nil
+		if len(ep.blocks) > 0 {
+			ep.block = ep.blocks[0]
+			ep.outbuf = ep.block
+			ep.blocks[0] = nil
+			ep.blocks = ep.blocks[1:]
+			// a slot freed up, so a waiting piece may be able to continue.
+			er.cv.Broadcast()
+			continue
+		}
+		if er.err != nil {
+			return 0, er.err
+		}
+		if !er.reading && er.ready() {
+			er.fill()
+			continue
 		}
+		er.wait()
 	}
 
-	n = copy(p, outbufs[i])
-	copy(outbufs[i], outbufs[i][n:])
-	outbufs[i] = outbufs[i][:len(outbufs[i])-n]
-	if len(outbufs[i]) <= 0 {
-		ep.er.piecesRemaining -= 1
-	}
+	n = copy(p, ep.outbuf)
+	ep.outbuf = ep.outbuf[n:]
 	return n, nil
 }
 
@@ -149,11 +353,18 @@ func (er *EncodedRanger) OutputSize() int64 {
 
 // Range is like Ranger.Range, but returns a slice of Readers
 func (er *EncodedRanger) Range(offset, length int64) ([]io.Reader, error) {
+	return er.RangeContext(context.Background(), offset, length)
+}
+
+// RangeContext is like Range, but the returned Readers stop with ctx.Err()
+// once ctx is done.
+func (er *EncodedRanger) RangeContext(ctx context.Context,
+	offset, length int64) ([]io.Reader, error) {
 	firstBlock, blockCount := calcEncompassingBlocks(
 		offset, length, er.es.EncodedBlockSize())
-	readers := EncodeReader(er.rr.Range(
+	readers := EncodeReaderContext(ctx, ranger.RangeContext(ctx, er.rr,
 		firstBlock*int64(er.es.DecodedBlockSize()),
-		blockCount*int64(er.es.DecodedBlockSize())), er.es)
+		blockCount*int64(er.es.DecodedBlockSize())), er.es, EncoderOptions{})
 
 	for i, r := range readers {
 		_, err := io.CopyN(ioutil.Discard, r,
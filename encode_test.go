@@ -0,0 +1,135 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/vivint/infectious"
+)
+
+func TestEncodeLookahead(t *testing.T) {
+	const blocks = 4
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 1024)
+	data := randData(rs.DecodedBlockSize() * blocks)
+	readers := EncodeReaderWithOptions(bytes.NewReader(data), rs,
+		EncoderOptions{Lookahead: blocks + 1})
+
+	// with enough lookahead, each piece can be read to completion (including
+	// EOF) before any of the others are touched.
+	pieces := make(map[int][]byte, len(readers))
+	for i, r := range readers {
+		piece, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(piece) != rs.EncodedBlockSize()*blocks {
+			t.Fatalf("unexpected piece size: %d", len(piece))
+		}
+		pieces[i] = piece
+	}
+
+	readerMap := make(map[int]io.Reader, len(pieces))
+	for i, piece := range pieces {
+		readerMap[i] = bytes.NewReader(piece)
+	}
+	data2, err := ioutil.ReadAll(DecodeReaders(readerMap, rs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Fatalf("encode/decode with lookahead failed")
+	}
+}
+
+func TestEncodeAbandonSlowPieces(t *testing.T) {
+	const blocks = 8
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 1024)
+	data := randData(rs.DecodedBlockSize() * blocks)
+	readers := EncodeReaderWithOptions(bytes.NewReader(data), rs,
+		EncoderOptions{Lookahead: 2, AbandonSlowPieces: true})
+
+	// never read pieces 2 and 3. they should get abandoned instead of
+	// stalling pieces 0 and 1.
+	readerMap := map[int]io.Reader{0: readers[0], 1: readers[1]}
+	data2, err := ioutil.ReadAll(DecodeReaders(readerMap, rs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Fatalf("encode/decode with abandoned pieces failed")
+	}
+
+	for _, i := range []int{2, 3} {
+		_, err = readers[i].Read(make([]byte, 1))
+		if !AbandonedError.Contains(err) {
+			t.Fatalf("expected piece %d to be abandoned, got %v", i, err)
+		}
+	}
+}
+
+func TestEncodeWorkers(t *testing.T) {
+	fc, err := infectious.NewFEC(3, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 256)
+	// not a multiple of the number of workers, so the last batch is short
+	data := randData(rs.DecodedBlockSize() * 13)
+	readers := EncodeReaderWithOptions(bytes.NewReader(data), rs,
+		EncoderOptions{Workers: 4, Lookahead: 8})
+	readerMap := make(map[int]io.Reader, len(readers))
+	for i, reader := range readers {
+		readerMap[i] = reader
+	}
+	data2, err := ioutil.ReadAll(DecodeReaders(readerMap, rs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Fatalf("encode/decode with workers failed")
+	}
+}
+
+func BenchmarkEncodeReader(b *testing.B) {
+	fc, err := infectious.NewFEC(20, 40)
+	if err != nil {
+		b.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 4*1024)
+	data := randData(rs.DecodedBlockSize() * 16)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				readers := EncodeReaderWithOptions(bytes.NewReader(data), rs,
+					EncoderOptions{Workers: workers, Lookahead: 2 * workers})
+				errs := make(chan error, len(readers))
+				for _, r := range readers {
+					go func(r io.Reader) {
+						_, err := io.Copy(ioutil.Discard, r)
+						errs <- err
+					}(r)
+				}
+				for range readers {
+					if err := <-errs; err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
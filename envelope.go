@@ -0,0 +1,111 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"crypto/rand"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// KeyWrapType identifies how a WrappedKey was encrypted.
+type KeyWrapType uint8
+
+const (
+	// KeyWrapSecretbox is a key encrypted with secretbox under a symmetric
+	// key-encryption key, by WrapKey.
+	KeyWrapSecretbox KeyWrapType = 1
+	// KeyWrapBox is a key encrypted with nacl/box to an X25519 recipient, by
+	// WrapKeyForRecipient.
+	KeyWrapBox KeyWrapType = 2
+)
+
+// A WrappedKey is an object's data key, encrypted so that only the holder of
+// a key-encryption key can recover it. Objects are encrypted with a random
+// data key, and only the wrapped data key is stored with them, so changing
+// the key-encryption key means rewrapping the data key rather than
+// reencrypting the object.
+type WrappedKey struct {
+	Type KeyWrapType
+	Data []byte
+}
+
+func (w WrappedKey) equal(o WrappedKey) bool {
+	return w.Type == o.Type && string(w.Data) == string(o.Data)
+}
+
+// NewDataKey returns a random KeySize key to encrypt a single object with.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	return key, nil
+}
+
+// WrapKey encrypts dataKey with the key-encryption key kek.
+func WrapKey(kek, dataKey []byte) (WrappedKey, error) {
+	var key [32]byte
+	err := setKey(&key, kek)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	var nonce [24]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		return WrappedKey{}, Error.Wrap(err)
+	}
+	return WrappedKey{
+		Type: KeyWrapSecretbox,
+		Data: secretbox.Seal(nonce[:], dataKey, &nonce, &key),
+	}, nil
+}
+
+// UnwrapKey returns the data key in the first of keys that kek can decrypt.
+func UnwrapKey(kek []byte, keys []WrappedKey) ([]byte, error) {
+	var key [32]byte
+	err := setKey(&key, kek)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range keys {
+		if w.Type != KeyWrapSecretbox || len(w.Data) < 24 {
+			continue
+		}
+		var nonce [24]byte
+		copy(nonce[:], w.Data)
+		dataKey, ok := secretbox.Open(nil, w.Data[24:], &nonce, &key)
+		if ok {
+			return dataKey, nil
+		}
+	}
+	return nil, Error.New("no data key wrapped with this key")
+}
+
+// RewrapKey returns a copy of keys where every key wrapped with oldKEK is
+// wrapped with newKEK instead. It fails if none of them were wrapped with
+// oldKEK.
+func RewrapKey(oldKEK, newKEK []byte, keys []WrappedKey) (
+	[]WrappedKey, error) {
+	rv := make([]WrappedKey, 0, len(keys))
+	found := false
+	for _, w := range keys {
+		dataKey, err := UnwrapKey(oldKEK, []WrappedKey{w})
+		if err != nil {
+			rv = append(rv, w)
+			continue
+		}
+		w, err = WrapKey(newKEK, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, w)
+		found = true
+	}
+	if !found {
+		return nil, Error.New("no data key wrapped with this key")
+	}
+	return rv, nil
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrapKey(t *testing.T) {
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek1, kek2, kek3 := randData(KeySize), randData(KeySize), randData(KeySize)
+	wrapped1, err := WrapKey(kek1, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped2, err := WrapKey(kek2, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []WrappedKey{wrapped1, wrapped2}
+	for _, kek := range [][]byte{kek1, kek2} {
+		unwrapped, err := UnwrapKey(kek, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(unwrapped, dataKey) {
+			t.Fatalf("unwrapped the wrong key")
+		}
+	}
+	if _, err := UnwrapKey(kek3, keys); err == nil {
+		t.Fatalf("expected unwrapping with the wrong key to fail")
+	}
+
+	// rotating kek1 to kek3 leaves the data key, and kek2, alone
+	rewrapped, err := RewrapKey(kek1, kek3, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnwrapKey(kek1, rewrapped); err == nil {
+		t.Fatalf("expected the old key to stop working")
+	}
+	for _, kek := range [][]byte{kek2, kek3} {
+		unwrapped, err := UnwrapKey(kek, rewrapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(unwrapped, dataKey) {
+			t.Fatalf("unwrapped the wrong key")
+		}
+	}
+	if _, err := RewrapKey(kek1, kek3, rewrapped); err == nil {
+		t.Fatalf("expected rewrapping with the wrong key to fail")
+	}
+}
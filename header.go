@@ -0,0 +1,305 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/jtolds/eestream/ranger"
+)
+
+const (
+	pieceMagic = "EEPC"
+	// new fields are only ever added to the end of the header, where older
+	// readers skip them, so pieceVersion only changes if the existing fields
+	// or the way the data is encoded change in a way older readers would
+	// get wrong.
+	pieceVersion = 1
+
+	// magic, version and header length come first in every version, so a
+	// reader can find out how much header there is before parsing it.
+	pieceHeaderPrefixSize = len(pieceMagic) + 1 + 2
+	// pieceHeaderSize is the size of a header whose Manifest has no strings
+	// or wrapped keys.
+	pieceHeaderSize    = pieceHeaderPrefixSize + 2 + manifestSize
+	maxPieceHeaderSize = 1<<16 - 1
+)
+
+// SchemeType identifies an ErasureScheme implementation in a Manifest.
+type SchemeType uint8
+
+const (
+	// SchemeReedSolomon is the ErasureScheme returned by NewRSScheme.
+	SchemeReedSolomon SchemeType = 1
+)
+
+// PieceHeader describes how a piece was encoded, so that it can be decoded
+// without any other information. It is written at the start of a piece.
+type PieceHeader struct {
+	PieceNum int
+	Manifest
+}
+
+// NewPieceHeader returns the PieceHeader for piece pieceNum of data encoded
+// with es.
+func NewPieceHeader(es ErasureScheme, pieceNum int, plaintextSize int64) (
+	*PieceHeader, error) {
+	m, err := NewManifest(es, plaintextSize)
+	if err != nil {
+		return nil, err
+	}
+	if pieceNum < 0 || pieceNum >= es.TotalCount() {
+		return nil, Error.New("invalid piece number %d", pieceNum)
+	}
+	return &PieceHeader{PieceNum: pieceNum, Manifest: *m}, nil
+}
+
+// Size returns the encoded length of the header.
+func (h *PieceHeader) Size() int {
+	return pieceHeaderPrefixSize + 2 + h.Manifest.Size()
+}
+
+// sameEncoding returns true if h and o describe pieces of the same encoded
+// data.
+func (h *PieceHeader) sameEncoding(o *PieceHeader) bool {
+	return h.Manifest.equal(&o.Manifest)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (h *PieceHeader) MarshalBinary() ([]byte, error) {
+	if h.Size() > maxPieceHeaderSize {
+		return nil, Error.New("piece header too large")
+	}
+	manifest, err := h.Manifest.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, h.Size())
+	buf = append(buf, pieceMagic...)
+	buf = append(buf, pieceVersion)
+	buf = appendUint16(buf, h.Size())
+	buf = appendUint16(buf, h.PieceNum)
+	return append(buf, manifest...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. Any data past the
+// fields this version of the package knows about is ignored.
+func (h *PieceHeader) UnmarshalBinary(data []byte) error {
+	size, err := parsePieceHeaderPrefix(data)
+	if err != nil {
+		return err
+	}
+	if len(data) < size {
+		return Error.New("piece header truncated")
+	}
+	if size < pieceHeaderSize {
+		return Error.New("piece header too short")
+	}
+	data = data[pieceHeaderPrefixSize:size]
+	var o PieceHeader
+	o.PieceNum = int(binary.BigEndian.Uint16(data[:2]))
+	err = o.Manifest.UnmarshalBinary(data[2:])
+	if err != nil {
+		return err
+	}
+	err = o.validate()
+	if err != nil {
+		return err
+	}
+	*h = o
+	return nil
+}
+
+// validate checks the fields that decoding relies on, so a corrupt header
+// fails here instead of partway through decoding.
+func (h *PieceHeader) validate() error {
+	if h.BlockSize <= 0 {
+		return Error.New("invalid block size %d", h.BlockSize)
+	}
+	if h.PieceNum >= h.Total {
+		return Error.New("invalid piece number %d of %d", h.PieceNum, h.Total)
+	}
+	if h.Pipeline == "" {
+		return nil
+	}
+	// the data is erasure decoded with the header's scheme, but decrypted
+	// with the pipeline's block layout, so they have to agree.
+	config, err := ParsePipelineSpec(h.Pipeline)
+	if err != nil {
+		return err
+	}
+	if h.Scheme != SchemeReedSolomon || config.Required != h.Required ||
+		config.Total != h.Total || config.PieceBlockSize != h.BlockSize {
+		return Error.New("pipeline %q doesn't match the header's %d/%d@%d "+
+			"erasure scheme", h.Pipeline, h.Required, h.Total, h.BlockSize)
+	}
+	return nil
+}
+
+// parsePieceHeaderPrefix checks the magic and version at the start of data
+// and returns the header length.
+func parsePieceHeaderPrefix(data []byte) (size int, err error) {
+	if len(data) < pieceHeaderPrefixSize {
+		return 0, Error.New("piece header truncated")
+	}
+	if string(data[:len(pieceMagic)]) != pieceMagic {
+		return 0, Error.New("not a piece: bad magic number")
+	}
+	if data[len(pieceMagic)] != pieceVersion {
+		return 0, Error.New("unsupported piece version %d",
+			data[len(pieceMagic)])
+	}
+	return int(binary.BigEndian.Uint16(data[len(pieceMagic)+1:])), nil
+}
+
+// WriteTo implements io.WriterTo.
+func (h *PieceHeader) WriteTo(w io.Writer) (int64, error) {
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadPieceHeader reads a PieceHeader from the start of r, leaving r at the
+// start of the piece data.
+func ReadPieceHeader(r io.Reader) (*PieceHeader, error) {
+	buf := make([]byte, pieceHeaderPrefixSize)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	size, err := parsePieceHeaderPrefix(buf)
+	if err != nil {
+		return nil, err
+	}
+	if size < pieceHeaderPrefixSize {
+		return nil, Error.New("piece header too short")
+	}
+	buf = append(buf, make([]byte, size-pieceHeaderPrefixSize)...)
+	_, err = io.ReadFull(r, buf[pieceHeaderPrefixSize:])
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	var h PieceHeader
+	return &h, h.UnmarshalBinary(buf)
+}
+
+// AddPieceHeaders takes the Readers returned from EncodeReader and returns
+// Readers that start with a copy of h, numbered to match each piece.
+func AddPieceHeaders(readers []io.Reader, h PieceHeader) (
+	[]io.Reader, error) {
+	if len(readers) != h.Total {
+		return nil, Error.New("expected %d pieces, got %d", h.Total,
+			len(readers))
+	}
+	rv := make([]io.Reader, 0, len(readers))
+	for i, r := range readers {
+		h.PieceNum = i
+		buf, err := h.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, io.MultiReader(bytes.NewReader(buf), r))
+	}
+	return rv, nil
+}
+
+// ParsePiece reads the PieceHeader at the start of rr and returns it along
+// with a Ranger of the piece data that follows it.
+func ParsePiece(rr ranger.Ranger) (*PieceHeader, ranger.Ranger, error) {
+	buf, err := readHeaderRange(rr, pieceHeaderPrefixSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	size, err := parsePieceHeaderPrefix(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf, err = readHeaderRange(rr, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	var h PieceHeader
+	err = h.UnmarshalBinary(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ranger.Subrange(rr, int64(size), rr.Size()-int64(size))
+	if err != nil {
+		return nil, nil, Error.Wrap(err)
+	}
+	return &h, data, nil
+}
+
+func readHeaderRange(rr ranger.Ranger, length int) ([]byte, error) {
+	if int64(length) > rr.Size() {
+		return nil, Error.New("piece header truncated")
+	}
+	buf := make([]byte, length)
+	_, err := io.ReadFull(rr.Range(0, int64(length)), buf)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	return buf, nil
+}
+
+// DecodePieces is like DecodeWithOptions, but works on pieces that start with
+// a PieceHeader, and figures out the ErasureScheme and piece numbers from
+// the headers. DecodePieces fails if the pieces weren't all encoded the same
+// way. The returned PieceHeader describes the encoding, and its PieceNum is
+// meaningless.
+func DecodePieces(pieces []ranger.Ranger, opts DecoderOptions) (
+	ranger.Ranger, *PieceHeader, error) {
+	if len(pieces) == 0 {
+		return nil, nil, Error.New("no pieces to decode")
+	}
+	var first *PieceHeader
+	rrs := make(map[int]ranger.Ranger, len(pieces))
+	for _, piece := range pieces {
+		h, data, err := ParsePiece(piece)
+		if err != nil {
+			return nil, nil, err
+		}
+		if first == nil {
+			first = h
+		} else if !first.sameEncoding(h) {
+			return nil, nil, Error.New("pieces are from different encodings")
+		}
+		if _, exists := rrs[h.PieceNum]; exists {
+			return nil, nil, Error.New("duplicate piece number %d", h.PieceNum)
+		}
+		rrs[h.PieceNum] = data
+	}
+	es, err := first.ErasureScheme()
+	if err != nil {
+		return nil, nil, err
+	}
+	rr, err := DecodeWithOptions(rrs, es, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rr, first, nil
+}
+
+func appendUint16(buf []byte, v int) []byte {
+	var tmp [2]byte
+	binary.BigEndian.PutUint16(tmp[:], uint16(v))
+	return append(buf, tmp[:]...)
+}
+
+func appendUint32(buf []byte, v int) []byte {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], uint32(v))
+	return append(buf, tmp[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
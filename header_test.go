@@ -0,0 +1,203 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jtolds/eestream/ranger"
+	"github.com/vivint/infectious"
+)
+
+func TestPieceHeaderRoundTrip(t *testing.T) {
+	fc, err := infectious.NewFEC(3, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewPieceHeader(NewRSScheme(fc, 512), 5, 12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.NoncePrefix, err = NewNoncePrefix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.KeySalt, err = NewKeySalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := WrapKey(randData(KeySize), randData(KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(h.MerkleRoot[:], randData(len(h.MerkleRoot)))
+	h.Pipeline = "pad,secretbox,rs:3/7@512"
+	h.Name = "hello.txt"
+	h.ModTime = time.Unix(1527000000, 0)
+	h.WrappedKeys = []WrappedKey{wrapped, {Type: 99, Data: []byte("x")}}
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// newer headers may have extra fields on the end
+	buf[len(pieceMagic)+2]++
+	buf = append(buf, 0xff)
+
+	h2, err := ReadPieceHeader(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, h2) {
+		t.Fatalf("header mismatch: %#v != %#v", h, h2)
+	}
+	es, err := h2.ErasureScheme()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if es.RequiredCount() != 3 || es.TotalCount() != 7 ||
+		es.EncodedBlockSize() != 512 {
+		t.Fatalf("unexpected erasure scheme")
+	}
+
+	buf[len(pieceMagic)]++
+	if _, err := ReadPieceHeader(bytes.NewReader(buf)); err == nil {
+		t.Fatalf("expected unknown piece version to fail")
+	}
+	buf[len(pieceMagic)]--
+
+	buf[0] = 'X'
+	if _, err := ReadPieceHeader(bytes.NewReader(buf)); err == nil {
+		t.Fatalf("expected bad magic number to fail")
+	}
+}
+
+func encodePiecesWithHeaders(t *testing.T, data []byte, es ErasureScheme) (
+	pieces []ranger.Ranger) {
+	readers := EncodeReaderWithOptions(bytes.NewReader(data), es,
+		EncoderOptions{Lookahead: len(data)/es.DecodedBlockSize() + 1})
+	h, err := NewPieceHeader(es, 0, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readers, err = AddPieceHeaders(readers, *h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range readers {
+		piece, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pieces = append(pieces, ranger.ByteRanger(piece))
+	}
+	return pieces
+}
+
+func TestDecodePieces(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 1024)
+	data := randData(rs.DecodedBlockSize() * 3)
+	pieces := encodePiecesWithHeaders(t, data, rs)
+
+	// pieces can be given in any order, and some can be missing.
+	rr, h, err := DecodePieces(
+		[]ranger.Ranger{pieces[3], pieces[0], pieces[2]}, DecoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.PlaintextSize != int64(len(data)) {
+		t.Fatalf("unexpected plaintext size %d", h.PlaintextSize)
+	}
+	data2, err := ioutil.ReadAll(rr.Range(0, rr.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Fatalf("decode with piece headers failed")
+	}
+
+	other := encodePiecesWithHeaders(t, data, NewRSScheme(fc, 512))
+	_, _, err = DecodePieces(
+		[]ranger.Ranger{pieces[0], other[1], pieces[2]}, DecoderOptions{})
+	if err == nil {
+		t.Fatalf("expected pieces from different encodings to fail")
+	}
+	_, _, err = DecodePieces(
+		[]ranger.Ranger{pieces[0], pieces[0], pieces[2]}, DecoderOptions{})
+	if err == nil {
+		t.Fatalf("expected duplicate pieces to fail")
+	}
+}
+
+// rewriteHeader returns piece with its header changed by rewrite.
+func rewriteHeader(t *testing.T, piece ranger.Ranger,
+	rewrite func(h *PieceHeader)) (header []byte, rewritten ranger.Ranger) {
+	h, data, err := ParsePiece(piece)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrite(h)
+	header, err = h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(data.Range(0, data.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header, ranger.ByteRanger(append(append([]byte(nil), header...),
+		buf...))
+}
+
+func TestDecodePiecesCorruptHeader(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 64)
+	data := randData(rs.DecodedBlockSize() * 3)
+	pieces := encodePiecesWithHeaders(t, data, rs)
+
+	for _, test := range []struct {
+		name    string
+		corrupt func(h *PieceHeader)
+	}{
+		{"zero block size", func(h *PieceHeader) { h.BlockSize = 0 }},
+		{"piece number out of range", func(h *PieceHeader) { h.PieceNum = 4 }},
+		{"wrong pipeline", func(h *PieceHeader) { h.Pipeline = "rs:2/4@32" }},
+	} {
+		// every piece is corrupted the same way, so they still agree.
+		corrupt := make([]ranger.Ranger, 0, len(pieces))
+		for _, piece := range pieces {
+			header, rr := rewriteHeader(t, piece, test.corrupt)
+			if _, err := ReadPieceHeader(bytes.NewReader(header)); err == nil {
+				t.Fatalf("%s: expected header to fail", test.name)
+			}
+			corrupt = append(corrupt, rr)
+		}
+		_, _, err = DecodePieces(corrupt, DecoderOptions{})
+		if err == nil {
+			t.Fatalf("%s: expected decode to fail", test.name)
+		}
+	}
+
+	// a pipeline that matches is fine.
+	var matching []ranger.Ranger
+	for _, piece := range pieces {
+		_, rr := rewriteHeader(t, piece, func(h *PieceHeader) {
+			h.Pipeline = "secretbox,rs:2/4@64"
+		})
+		matching = append(matching, rr)
+	}
+	if _, _, err := DecodePieces(matching, DecoderOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// IntegrityAlgorithm selects the checksum or MAC that NewIntegrityAdder
+// appends to every block.
+type IntegrityAlgorithm int
+
+const (
+	// IntegrityCRC32C is a CRC-32C checksum. It catches accidental
+	// corruption such as bit rot cheaply, but anyone can forge it.
+	IntegrityCRC32C IntegrityAlgorithm = 1
+	// IntegrityBLAKE2b is a keyed BLAKE2b-256 MAC.
+	IntegrityBLAKE2b IntegrityAlgorithm = 2
+	// IntegrityHMACSHA256 is an HMAC-SHA256 MAC.
+	IntegrityHMACSHA256 IntegrityAlgorithm = 3
+)
+
+// IntegrityError is the class of errors returned when a block fails its
+// integrity check.
+var IntegrityError = Error.NewClass("integrity check failed")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type integrity struct {
+	alg       IntegrityAlgorithm
+	key       []byte
+	blockSize int
+	sumSize   int
+}
+
+func newIntegrity(alg IntegrityAlgorithm, key []byte, blockSize int) (
+	*integrity, error) {
+	if blockSize <= 0 {
+		return nil, Error.New("invalid block size %d", blockSize)
+	}
+	i := &integrity{
+		alg:       alg,
+		key:       append([]byte(nil), key...),
+		blockSize: blockSize,
+	}
+	switch alg {
+	case IntegrityCRC32C:
+		if len(key) != 0 {
+			return nil, Error.New("crc32c doesn't take a key")
+		}
+		i.sumSize = crc32.Size
+	case IntegrityBLAKE2b:
+		if len(key) == 0 || len(key) > blake2b.Size {
+			return nil, Error.New("invalid key length for blake2b")
+		}
+		i.sumSize = blake2b.Size256
+	case IntegrityHMACSHA256:
+		if len(key) == 0 {
+			return nil, Error.New("hmac-sha256 needs a key")
+		}
+		i.sumSize = sha256.Size
+	default:
+		return nil, Error.New("unknown integrity algorithm %d", alg)
+	}
+	return i, nil
+}
+
+// sum appends the checksum of data and blockNum to out.
+func (i *integrity) sum(out, data []byte, blockNum int64) []byte {
+	var h hash.Hash
+	switch i.alg {
+	case IntegrityCRC32C:
+		h = crc32.New(castagnoli)
+	case IntegrityBLAKE2b:
+		// the key length was checked by newIntegrity, so this can't fail.
+		h, _ = blake2b.New256(i.key)
+	case IntegrityHMACSHA256:
+		h = hmac.New(sha256.New, i.key)
+	}
+	h.Write(data)
+	var num [8]byte
+	binary.BigEndian.PutUint64(num[:], uint64(blockNum))
+	h.Write(num[:])
+	return h.Sum(out)
+}
+
+type integrityAdder struct {
+	*integrity
+}
+
+// NewIntegrityAdder returns a Transformer that appends the block number and a
+// checksum or MAC of the block and its number to every block of blockSize
+// bytes, so that NewIntegrityChecker can tell if a block was corrupted or
+// moved. key is the MAC key, and must be empty for IntegrityCRC32C.
+func NewIntegrityAdder(alg IntegrityAlgorithm, key []byte, blockSize int) (
+	Transformer, error) {
+	i, err := newIntegrity(alg, key, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	return &integrityAdder{integrity: i}, nil
+}
+
+func (i *integrityAdder) InBlockSize() int {
+	return i.blockSize
+}
+
+func (i *integrityAdder) OutBlockSize() int {
+	return i.blockSize + 8 + i.sumSize
+}
+
+// Inverse implements InvertibleTransformer.
+func (i *integrityAdder) Inverse() Transformer {
+	return &integrityChecker{integrity: i.integrity}
+}
+
+func (i *integrityAdder) Transform(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	out = append(out, in...)
+	out = appendUint64(out, uint64(blockNum))
+	return i.sum(out, in, blockNum), nil
+}
+
+type integrityChecker struct {
+	*integrity
+}
+
+// NewIntegrityChecker returns a Transformer that checks and strips what
+// NewIntegrityAdder added. alg, key and blockSize must match the adder's.
+func NewIntegrityChecker(alg IntegrityAlgorithm, key []byte, blockSize int) (
+	Transformer, error) {
+	i, err := newIntegrity(alg, key, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	return &integrityChecker{integrity: i}, nil
+}
+
+func (i *integrityChecker) InBlockSize() int {
+	return i.blockSize + 8 + i.sumSize
+}
+
+func (i *integrityChecker) OutBlockSize() int {
+	return i.blockSize
+}
+
+// Inverse implements InvertibleTransformer.
+func (i *integrityChecker) Inverse() Transformer {
+	return &integrityAdder{integrity: i.integrity}
+}
+
+func (i *integrityChecker) Transform(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	data := in[:i.blockSize]
+	num := int64(binary.BigEndian.Uint64(in[i.blockSize : i.blockSize+8]))
+	if !hmac.Equal(i.sum(nil, data, num), in[i.blockSize+8:]) {
+		return nil, IntegrityError.New("block %d is corrupt", blockNum)
+	}
+	if num != blockNum {
+		return nil, IntegrityError.New("block %d holds block %d", blockNum,
+			num)
+	}
+	return append(out, data...), nil
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/jtolds/eestream/ranger"
+)
+
+func TestIntegrity(t *testing.T) {
+	const blocks = 5
+	for _, test := range []struct {
+		alg IntegrityAlgorithm
+		key []byte
+	}{
+		{IntegrityCRC32C, nil},
+		{IntegrityBLAKE2b, randData(32)},
+		{IntegrityHMACSHA256, randData(32)},
+	} {
+		adder, err := NewIntegrityAdder(test.alg, test.key, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checker, err := Invert(adder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := randData(100 * blocks)
+		checked, err := ioutil.ReadAll(TransformReader(bytes.NewReader(data),
+			adder, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(checked) != adder.OutBlockSize()*blocks {
+			t.Fatalf("unexpected size %d", len(checked))
+		}
+		rr, err := Transform(ranger.ByteRanger(checked), checker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data2, err := ioutil.ReadAll(rr.Range(150, 200))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[150:350], data2) {
+			t.Fatalf("%d: round trip failed", test.alg)
+		}
+
+		expectFailure := func(what string, checker Transformer, in []byte,
+			blockNum int64, msg string) {
+			_, err := checker.Transform(nil, in, blockNum)
+			if !IntegrityError.Contains(err) ||
+				!strings.Contains(err.Error(), msg) {
+				t.Fatalf("%d: %s: unexpected error %v", test.alg, what, err)
+			}
+		}
+		block := func(n int) []byte {
+			size := adder.OutBlockSize()
+			return append([]byte(nil), checked[n*size:(n+1)*size]...)
+		}
+
+		corrupt := block(3)
+		corrupt[10] ^= 1
+		expectFailure("corrupt", checker, corrupt, 3, "block 3 is corrupt")
+		expectFailure("moved", checker, block(1), 2, "block 2 holds block 1")
+
+		if test.key != nil {
+			other, err := NewIntegrityChecker(test.alg, randData(32), 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectFailure("wrong key", other, block(0), 0, "block 0 is corrupt")
+		}
+	}
+
+	_, err := NewIntegrityAdder(IntegrityHMACSHA256, nil, 100)
+	if err == nil {
+		t.Fatalf("expected a MAC without a key to fail")
+	}
+	_, err = NewIntegrityAdder(IntegrityCRC32C, []byte("k"), 100)
+	if err == nil {
+		t.Fatalf("expected a keyed crc32c to fail")
+	}
+}
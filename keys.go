@@ -0,0 +1,56 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeySize is the size of the keys DeriveObjectKey and DeriveSegmentKey
+// return, which suits every encrypter in this package.
+const KeySize = 32
+
+// DeriveObjectKey derives the key for the object identified by objectID from
+// masterKey with HKDF-SHA256. Every object gets its own key, so learning one
+// object's key reveals nothing about the others, and nonces can't be reused
+// across objects as long as object ids are unique.
+func DeriveObjectKey(masterKey, objectID []byte) ([]byte, error) {
+	if len(masterKey) == 0 {
+		return nil, Error.New("empty master key")
+	}
+	if len(objectID) == 0 {
+		return nil, Error.New("empty object id")
+	}
+	return deriveKey(masterKey, "eestream object key", objectID)
+}
+
+// DeriveSegmentKey derives a subkey for segment number segment of an object
+// from the object's key, for objects that are stored as several separately
+// encrypted streams.
+func DeriveSegmentKey(objectKey []byte, segment int64) ([]byte, error) {
+	if len(objectKey) == 0 {
+		return nil, Error.New("empty object key")
+	}
+	if segment < 0 {
+		return nil, Error.New("invalid segment %d", segment)
+	}
+	return deriveKey(objectKey, "eestream segment key",
+		appendUint64(nil, uint64(segment)))
+}
+
+func deriveKey(secret []byte, purpose string, id []byte) ([]byte, error) {
+	info := make([]byte, 0, 4+len(purpose)+len(id))
+	info = appendUint32(info, len(purpose))
+	info = append(info, purpose...)
+	info = append(info, id...)
+	key := make([]byte, KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	return key, nil
+}
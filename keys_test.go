@@ -0,0 +1,59 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"testing"
+)
+
+func TestDeriveKeys(t *testing.T) {
+	master := randData(32)
+	derive := func(master, objectID []byte, segment int64) string {
+		key, err := DeriveObjectKey(master, objectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(key) != KeySize {
+			t.Fatalf("unexpected key size %d", len(key))
+		}
+		if segment >= 0 {
+			key, err = DeriveSegmentKey(key, segment)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return string(key)
+	}
+
+	// the same inputs always derive the same key
+	if derive(master, []byte("a"), -1) != derive(master, []byte("a"), -1) ||
+		derive(master, []byte("a"), 1) != derive(master, []byte("a"), 1) {
+		t.Fatalf("key derivation isn't deterministic")
+	}
+
+	seen := map[string]bool{}
+	for _, key := range []string{
+		derive(master, []byte("a"), -1),
+		derive(master, []byte("b"), -1),
+		derive(randData(32), []byte("a"), -1),
+		derive(master, []byte("a"), 0),
+		derive(master, []byte("a"), 1),
+		derive(master, []byte("b"), 0),
+	} {
+		if seen[key] {
+			t.Fatalf("derived the same key twice")
+		}
+		seen[key] = true
+	}
+
+	if _, err := DeriveObjectKey(master, nil); err == nil {
+		t.Fatalf("expected an empty object id to fail")
+	}
+	if _, err := DeriveObjectKey(nil, []byte("a")); err == nil {
+		t.Fatalf("expected an empty master key to fail")
+	}
+	if _, err := DeriveSegmentKey(master, -1); err == nil {
+		t.Fatalf("expected a negative segment to fail")
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"io"
+)
+
+// readFastest is like readBlock, but returns as soon as RequiredCount pieces
+// have the current block in dr.inbufs. Pieces that are still working on an
+// earlier block are left out of dr.inbufs.
+func (dr *decodedReader) readFastest() error {
+	for _, w := range dr.workers {
+		if !w.busy {
+			w.request()
+		}
+	}
+
+	required := dr.es.RequiredCount()
+	got := make(map[int][]byte, len(dr.workers))
+	eofs := map[int]bool{}
+	for len(got) < required {
+		busy := 0
+		for _, w := range dr.workers {
+			if w.busy {
+				busy++
+			}
+		}
+		if len(got)+busy < required {
+			break
+		}
+
+		var res pieceResult
+		select {
+		case res = <-dr.results:
+		case <-dr.ctx.Done():
+			return dr.ctx.Err()
+		}
+		w := dr.workers[res.num]
+		w.busy = false
+		switch {
+		case res.err == io.EOF && w.reading == dr.blockNum:
+			eofs[w.num] = true
+		case res.err != nil:
+			dr.fail(w.num, res.err)
+		case w.reading < dr.blockNum:
+			// a straggler finished a block we've already decoded without it.
+			// throw it away and have it read the next one.
+			w.request()
+		default:
+			got[w.num] = w.buf
+		}
+	}
+
+	if len(got) == 0 && len(eofs) > 0 {
+		return io.EOF
+	}
+	// if some pieces ended but others didn't, the ones that ended were cut
+	// short.
+	for i := range eofs {
+		dr.fail(i, io.ErrUnexpectedEOF)
+	}
+	if len(got) < required {
+		return &PieceErrors{Required: required, Failed: dr.failed}
+	}
+	dr.inbufs = got
+	return nil
+}
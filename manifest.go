@@ -0,0 +1,256 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/vivint/infectious"
+)
+
+const (
+	manifestVersion = 1
+	// manifestSize is the size of a Manifest without any strings or wrapped
+	// keys.
+	manifestSize = 1 + 1 + 2 + 2 + 4 + 8 + 4 + NoncePrefixSize + KeySaltSize +
+		len(MerkleRoot{}) + 4 + 8 + 2 + 2 + 2 + 1
+)
+
+// A Manifest records everything about how an object was encoded that is
+// needed to decode it, along with a little metadata about the object itself.
+// Every piece header carries a copy.
+type Manifest struct {
+	Scheme   SchemeType
+	Required int
+	Total    int
+	// BlockSize is the ErasureScheme's EncodedBlockSize.
+	BlockSize int
+	// Pipeline is the spec of the PipelineConfig the data was encoded with,
+	// if any.
+	Pipeline string
+	// PlaintextSize is the size of the original data before padding and any
+	// Transformers were applied, or -1 if it isn't known.
+	PlaintextSize int64
+	// Padding is the number of bytes of padding added to the plaintext. It
+	// is only meaningful if PlaintextSize is known.
+	Padding int
+	// NoncePrefix is the NoncePrefix the data was encrypted with, if any.
+	NoncePrefix NoncePrefix
+	// KeySalt is the salt the encryption key was derived from a passphrase
+	// with, if any.
+	KeySalt KeySalt
+	// WrappedKeys are the data key the data was encrypted with, wrapped by
+	// each of the keys that should be able to decrypt it.
+	WrappedKeys []WrappedKey
+	// MerkleRoot is the root of the MerkleTree of the plaintext, if there is
+	// one, and MerkleBlockSize is the tree's block size.
+	MerkleRoot      MerkleRoot
+	MerkleBlockSize int
+	// Name, ContentType and ModTime describe the original data, and are
+	// optional.
+	Name        string
+	ContentType string
+	ModTime     time.Time
+}
+
+// NewManifest returns the Manifest for data of plaintextSize bytes encoded
+// with es and nothing else.
+func NewManifest(es ErasureScheme, plaintextSize int64) (*Manifest, error) {
+	if _, ok := es.(*rsScheme); !ok {
+		return nil, Error.New("unsupported erasure scheme")
+	}
+	return &Manifest{
+		Scheme:        SchemeReedSolomon,
+		Required:      es.RequiredCount(),
+		Total:         es.TotalCount(),
+		BlockSize:     es.EncodedBlockSize(),
+		PlaintextSize: plaintextSize,
+	}, nil
+}
+
+// ErasureScheme returns an ErasureScheme that can decode the data.
+func (m *Manifest) ErasureScheme() (ErasureScheme, error) {
+	if m.BlockSize <= 0 {
+		return nil, Error.New("invalid block size %d", m.BlockSize)
+	}
+	switch m.Scheme {
+	case SchemeReedSolomon:
+		fc, err := infectious.NewFEC(m.Required, m.Total)
+		if err != nil {
+			return nil, Error.Wrap(err)
+		}
+		return NewRSScheme(fc, m.BlockSize), nil
+	default:
+		return nil, Error.New("unknown erasure scheme %d", m.Scheme)
+	}
+}
+
+// Size returns the encoded length of the Manifest.
+func (m *Manifest) Size() int {
+	size := manifestSize + len(m.Pipeline) + len(m.Name) + len(m.ContentType)
+	for _, w := range m.WrappedKeys {
+		size += 1 + 2 + len(w.Data)
+	}
+	return size
+}
+
+func (m *Manifest) equal(o *Manifest) bool {
+	return m.Scheme == o.Scheme &&
+		m.Required == o.Required &&
+		m.Total == o.Total &&
+		m.BlockSize == o.BlockSize &&
+		m.Pipeline == o.Pipeline &&
+		m.PlaintextSize == o.PlaintextSize &&
+		m.Padding == o.Padding &&
+		m.NoncePrefix == o.NoncePrefix &&
+		m.KeySalt == o.KeySalt &&
+		sameWrappedKeys(m.WrappedKeys, o.WrappedKeys) &&
+		m.MerkleRoot == o.MerkleRoot &&
+		m.MerkleBlockSize == o.MerkleBlockSize &&
+		m.Name == o.Name &&
+		m.ContentType == o.ContentType &&
+		m.ModTime.Equal(o.ModTime)
+}
+
+func sameWrappedKeys(a, b []WrappedKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding only
+// depends on the lengths of the strings and keys, so a Manifest can be
+// rewritten in place once fields like PlaintextSize are known.
+func (m *Manifest) MarshalBinary() ([]byte, error) {
+	if len(m.Pipeline) > 1<<16-1 || len(m.Name) > 1<<16-1 ||
+		len(m.ContentType) > 1<<16-1 || len(m.WrappedKeys) > 255 {
+		return nil, Error.New("manifest too large")
+	}
+	var modTime int64
+	if !m.ModTime.IsZero() {
+		modTime = m.ModTime.UnixNano()
+	}
+	buf := make([]byte, 0, m.Size())
+	buf = append(buf, manifestVersion, byte(m.Scheme))
+	buf = appendUint16(buf, m.Required)
+	buf = appendUint16(buf, m.Total)
+	buf = appendUint32(buf, m.BlockSize)
+	buf = appendUint64(buf, uint64(m.PlaintextSize))
+	buf = appendUint32(buf, m.Padding)
+	buf = append(buf, m.NoncePrefix[:]...)
+	buf = append(buf, m.KeySalt[:]...)
+	buf = append(buf, m.MerkleRoot[:]...)
+	buf = appendUint32(buf, m.MerkleBlockSize)
+	buf = appendUint64(buf, uint64(modTime))
+	buf = appendString16(buf, m.Pipeline)
+	buf = appendString16(buf, m.Name)
+	buf = appendString16(buf, m.ContentType)
+	buf = append(buf, byte(len(m.WrappedKeys)))
+	for _, w := range m.WrappedKeys {
+		buf = append(buf, byte(w.Type))
+		buf = appendUint16(buf, len(w.Data))
+		buf = append(buf, w.Data...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. Any data past the
+// fields this version of the package knows about is ignored.
+func (m *Manifest) UnmarshalBinary(data []byte) error {
+	d := manifestDecoder{data: data}
+	if version := d.uint8(); d.err == nil && version != manifestVersion {
+		return Error.New("unsupported manifest version %d", version)
+	}
+	var o Manifest
+	o.Scheme = SchemeType(d.uint8())
+	o.Required = int(d.uint16())
+	o.Total = int(d.uint16())
+	o.BlockSize = int(d.uint32())
+	o.PlaintextSize = int64(d.uint64())
+	o.Padding = int(d.uint32())
+	copy(o.NoncePrefix[:], d.bytes(NoncePrefixSize))
+	copy(o.KeySalt[:], d.bytes(KeySaltSize))
+	copy(o.MerkleRoot[:], d.bytes(len(o.MerkleRoot)))
+	o.MerkleBlockSize = int(d.uint32())
+	if modTime := int64(d.uint64()); modTime != 0 {
+		o.ModTime = time.Unix(0, modTime)
+	}
+	o.Pipeline = d.string16()
+	o.Name = d.string16()
+	o.ContentType = d.string16()
+	count := int(d.uint8())
+	for i := 0; i < count && d.err == nil; i++ {
+		w := WrappedKey{Type: KeyWrapType(d.uint8())}
+		w.Data = append([]byte(nil), d.bytes(int(d.uint16()))...)
+		o.WrappedKeys = append(o.WrappedKeys, w)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	*m = o
+	return nil
+}
+
+// manifestDecoder reads big endian fields from the front of data. Once data
+// runs out, every read returns zero values and err is set.
+type manifestDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *manifestDecoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data) < n {
+		d.err = Error.New("manifest truncated")
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *manifestDecoder) uint8() uint8 {
+	if b := d.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *manifestDecoder) uint16() uint16 {
+	if b := d.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *manifestDecoder) uint32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *manifestDecoder) uint64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *manifestDecoder) string16() string {
+	return string(d.bytes(int(d.uint16())))
+}
+
+func appendString16(buf []byte, s string) []byte {
+	return append(appendUint16(buf, len(s)), s...)
+}
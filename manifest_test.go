@@ -0,0 +1,89 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	wrapped, err := WrapKey(randData(KeySize), randData(KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{
+		Scheme:          SchemeReedSolomon,
+		Required:        20,
+		Total:           40,
+		BlockSize:       4096,
+		Pipeline:        "pad,secretbox,rs:20/40@4096",
+		PlaintextSize:   1 << 40,
+		Padding:         1234,
+		WrappedKeys:     []WrappedKey{wrapped},
+		MerkleBlockSize: 64 * 1024,
+		Name:            "hello.txt",
+		ContentType:     "text/plain",
+		ModTime:         time.Unix(1527000000, 123),
+	}
+	copy(m.NoncePrefix[:], randData(NoncePrefixSize))
+	copy(m.KeySalt[:], randData(KeySaltSize))
+	copy(m.MerkleRoot[:], randData(len(m.MerkleRoot)))
+
+	for _, m := range []*Manifest{m, {PlaintextSize: -1}} {
+		buf, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) != m.Size() {
+			t.Fatalf("encoded %d bytes, expected %d", len(buf), m.Size())
+		}
+		var m2 Manifest
+		err = m2.UnmarshalBinary(append(buf, 0xff))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, &m2) || !m.equal(&m2) {
+			t.Fatalf("manifest mismatch: %#v != %#v", m, &m2)
+		}
+		for i := 0; i < len(buf); i++ {
+			if err := m2.UnmarshalBinary(buf[:i]); err == nil {
+				t.Fatalf("expected %d byte manifest to fail", i)
+			}
+		}
+		buf[0]++
+		if err := m2.UnmarshalBinary(buf); err == nil {
+			t.Fatalf("expected unknown manifest version to fail")
+		}
+	}
+}
+
+func TestPipelineManifest(t *testing.T) {
+	p := newTestPipeline(t, "pad,secretbox,rs:2/4@64")
+	data := randData(1000)
+	m, err := p.Manifest(int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := DecodeWithOptions(encodePipeline(t, p, data),
+		p.ErasureScheme(), DecoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := p.DecodeRanger(rr, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Size() != int64(len(data)) {
+		t.Fatalf("unexpected size %d", decoded.Size())
+	}
+
+	// a manifest that doesn't match the data is caught
+	bad := *m
+	bad.Padding++
+	if _, err := p.DecodeRanger(rr, &bad); err == nil {
+		t.Fatalf("expected wrong padding to fail")
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/jtolds/eestream/ranger"
+)
+
+// A MerkleRoot is the root hash of a MerkleTree.
+type MerkleRoot [sha256.Size]byte
+
+// A MerkleTree is a SHA-256 hash tree over the blocks of some data, shaped
+// like the trees of RFC 6962. Any range of blocks can be checked against the
+// root with the hashes of just those blocks and a few proof nodes.
+type MerkleTree struct {
+	blockSize int
+	size      int64
+	// levels holds every node of the tree, level by level from the leaves
+	// up. The node at index i of level k is the root of the subtree of
+	// leaves i<<k through (i+1)<<k-1, or through the last leaf if there are
+	// fewer.
+	levels [][][sha256.Size]byte
+}
+
+func merkleLeaf(data []byte) (h [sha256.Size]byte) {
+	d := sha256.New()
+	d.Write([]byte{0})
+	d.Write(data)
+	copy(h[:], d.Sum(nil))
+	return h
+}
+
+func merkleNode(left, right [sha256.Size]byte) (h [sha256.Size]byte) {
+	d := sha256.New()
+	d.Write([]byte{1})
+	d.Write(left[:])
+	d.Write(right[:])
+	copy(h[:], d.Sum(nil))
+	return h
+}
+
+// merkleSplit returns the number of leaves in the left subtree of a tree of
+// n > 1 leaves, which is the largest power of two less than n.
+func merkleSplit(n int64) int64 {
+	k := int64(1)
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// merkleLevels returns the levels of the tree with the given leaves.
+func merkleLevels(leaves [][sha256.Size]byte) [][][sha256.Size]byte {
+	levels := [][][sha256.Size]byte{leaves}
+	for len(leaves) > 1 {
+		next := make([][sha256.Size]byte, 0, (len(leaves)+1)/2)
+		for i := 0; i < len(leaves); i += 2 {
+			if i+1 == len(leaves) {
+				next = append(next, leaves[i])
+			} else {
+				next = append(next, merkleNode(leaves[i], leaves[i+1]))
+			}
+		}
+		levels = append(levels, next)
+		leaves = next
+	}
+	return levels
+}
+
+// BlockSize returns the size of the blocks the tree hashes. The last block
+// may be shorter.
+func (t *MerkleTree) BlockSize() int {
+	return t.blockSize
+}
+
+// Size returns the size of the data the tree hashes.
+func (t *MerkleTree) Size() int64 {
+	return t.size
+}
+
+// Root returns the root hash of the tree.
+func (t *MerkleTree) Root() MerkleRoot {
+	if t.count() == 0 {
+		return MerkleRoot(sha256.Sum256(nil))
+	}
+	return MerkleRoot(t.levels[len(t.levels)-1][0])
+}
+
+// count returns the number of blocks in the tree.
+func (t *MerkleTree) count() int64 {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return int64(len(t.levels[0]))
+}
+
+// hash returns the hash of the subtree of leaves lo through hi-1, which has
+// to be a subtree of the tree.
+func (t *MerkleTree) hash(lo, hi int64) [sha256.Size]byte {
+	k := uint(0)
+	for int64(1)<<k < hi-lo {
+		k++
+	}
+	return t.levels[k][lo>>k]
+}
+
+// Proof returns the proof nodes needed to check blocks first through end-1
+// against the root: the hashes of every largest subtree outside of them.
+func (t *MerkleTree) Proof(first, end int64) [][sha256.Size]byte {
+	return t.proof(0, t.count(), first, end, nil)
+}
+
+func (t *MerkleTree) proof(lo, hi, first, end int64,
+	proof [][sha256.Size]byte) [][sha256.Size]byte {
+	if hi <= first || end <= lo {
+		return append(proof, t.hash(lo, hi))
+	}
+	if hi-lo == 1 {
+		return proof
+	}
+	mid := lo + merkleSplit(hi-lo)
+	proof = t.proof(lo, mid, first, end, proof)
+	return t.proof(mid, hi, first, end, proof)
+}
+
+// verifyMerkleRange returns true if leaves, the hashes of blocks first
+// onward of a tree of count blocks, and proof hash to root.
+func verifyMerkleRange(root MerkleRoot, count, first int64,
+	leaves, proof [][sha256.Size]byte) bool {
+	end := first + int64(len(leaves))
+	if first < 0 || end > count || len(leaves) == 0 {
+		return false
+	}
+	var walk func(lo, hi int64) ([sha256.Size]byte, bool)
+	walk = func(lo, hi int64) ([sha256.Size]byte, bool) {
+		if hi <= first || end <= lo {
+			if len(proof) == 0 {
+				return [sha256.Size]byte{}, false
+			}
+			h := proof[0]
+			proof = proof[1:]
+			return h, true
+		}
+		if hi-lo == 1 {
+			return leaves[lo-first], true
+		}
+		mid := lo + merkleSplit(hi-lo)
+		left, ok := walk(lo, mid)
+		if !ok {
+			return left, false
+		}
+		right, ok := walk(mid, hi)
+		return merkleNode(left, right), ok
+	}
+	h, ok := walk(0, count)
+	return ok && len(proof) == 0 && MerkleRoot(h) == root
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. Every node of the tree
+// is included, so that proofs don't have to be computed from the leaves.
+func (t *MerkleTree) MarshalBinary() ([]byte, error) {
+	nodes := 0
+	for _, level := range t.levels {
+		nodes += len(level)
+	}
+	buf := make([]byte, 0, 4+8+nodes*sha256.Size)
+	buf = appendUint32(buf, t.blockSize)
+	buf = appendUint64(buf, uint64(t.size))
+	for _, level := range t.levels {
+		for _, node := range level {
+			buf = append(buf, node[:]...)
+		}
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (t *MerkleTree) UnmarshalBinary(data []byte) error {
+	if len(data) < 4+8 {
+		return Error.New("merkle tree truncated")
+	}
+	blockSize := int(binary.BigEndian.Uint32(data[:4]))
+	size := int64(binary.BigEndian.Uint64(data[4:12]))
+	data = data[12:]
+	if blockSize <= 0 || size < 0 {
+		return Error.New("invalid merkle tree")
+	}
+	count := (size + int64(blockSize) - 1) / int64(blockSize)
+	var levels [][][sha256.Size]byte
+	for {
+		if count > int64(len(data))/sha256.Size {
+			return Error.New("merkle tree has the wrong number of hashes")
+		}
+		level := make([][sha256.Size]byte, count)
+		for i := range level {
+			copy(level[i][:], data[i*sha256.Size:])
+		}
+		data = data[count*sha256.Size:]
+		levels = append(levels, level)
+		if count <= 1 {
+			break
+		}
+		count = (count + 1) / 2
+	}
+	if len(data) != 0 {
+		return Error.New("merkle tree has the wrong number of hashes")
+	}
+	t.blockSize, t.size, t.levels = blockSize, size, levels
+	return nil
+}
+
+// A MerkleHasher builds a MerkleTree over the data written to it.
+type MerkleHasher struct {
+	blockSize int
+	size      int64
+	leaves    [][sha256.Size]byte
+	buf       []byte
+}
+
+// NewMerkleHasher returns a MerkleHasher for blocks of blockSize bytes.
+func NewMerkleHasher(blockSize int) *MerkleHasher {
+	return &MerkleHasher{
+		blockSize: blockSize,
+		buf:       make([]byte, 0, blockSize),
+	}
+}
+
+// Write implements io.Writer.
+func (m *MerkleHasher) Write(p []byte) (n int, err error) {
+	n = len(p)
+	m.size += int64(n)
+	for len(p) > 0 {
+		amount := copy(m.buf[len(m.buf):cap(m.buf)], p)
+		m.buf = m.buf[:len(m.buf)+amount]
+		p = p[amount:]
+		if len(m.buf) == cap(m.buf) {
+			m.leaves = append(m.leaves, merkleLeaf(m.buf))
+			m.buf = m.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// Tree returns the MerkleTree of everything written so far.
+func (m *MerkleHasher) Tree() *MerkleTree {
+	leaves := append([][sha256.Size]byte(nil), m.leaves...)
+	if len(m.buf) > 0 {
+		leaves = append(leaves, merkleLeaf(m.buf))
+	}
+	return &MerkleTree{
+		blockSize: m.blockSize,
+		size:      m.size,
+		levels:    merkleLevels(leaves),
+	}
+}
+
+type merkleRanger struct {
+	rr   ranger.Ranger
+	tree MerkleTree
+	root MerkleRoot
+}
+
+// MerkleVerify returns a Ranger of rr that checks the data of every Range
+// against root, a known-good root hash. tree supplies the block hashes and
+// proof nodes, and doesn't have to be trusted: a Range checks the hashes of
+// just the blocks it touches against root using their proof, and fails with
+// an IntegrityError if they don't match, or if the blocks don't match their
+// hashes.
+func MerkleVerify(rr ranger.Ranger, tree *MerkleTree, root MerkleRoot) (
+	ranger.Ranger, error) {
+	if rr.Size() != tree.size {
+		return nil, Error.New("merkle tree is for %d bytes, not %d", tree.size,
+			rr.Size())
+	}
+	m := &merkleRanger{rr: rr, tree: *tree, root: root}
+	m.tree.levels = make([][][sha256.Size]byte, len(tree.levels))
+	for i, level := range tree.levels {
+		m.tree.levels[i] = append([][sha256.Size]byte(nil), level...)
+	}
+	return m, nil
+}
+
+func (m *merkleRanger) Size() int64 {
+	return m.rr.Size()
+}
+
+func (m *merkleRanger) Range(offset, length int64) io.Reader {
+	return m.RangeContext(context.Background(), offset, length)
+}
+
+func (m *merkleRanger) RangeContext(ctx context.Context,
+	offset, length int64) io.Reader {
+	if offset < 0 || length < 0 || offset+length > m.Size() {
+		return ranger.FatalReader(Error.New("range beyond end"))
+	}
+	if length == 0 {
+		return bytes.NewReader(nil)
+	}
+	blockSize := int64(m.tree.blockSize)
+	first, count := calcEncompassingBlocks(offset, length, m.tree.blockSize)
+	leaves := m.tree.levels[0][first : first+count]
+	if !verifyMerkleRange(m.root, m.tree.count(), first, leaves,
+		m.tree.Proof(first, first+count)) {
+		return ranger.FatalReader(IntegrityError.New(
+			"merkle tree doesn't match the root"))
+	}
+	start := first * blockSize
+	end := (first + count) * blockSize
+	if end > m.Size() {
+		end = m.Size()
+	}
+	r := &merkleReader{
+		r:        ranger.RangeContext(ctx, m.rr, start, end-start),
+		leaves:   leaves,
+		blockNum: first,
+		buf:      make([]byte, blockSize),
+		left:     end - start,
+	}
+	_, err := io.CopyN(ioutil.Discard, r, offset-start)
+	if err != nil {
+		return ranger.FatalReader(Error.Wrap(err))
+	}
+	return io.LimitReader(r, length)
+}
+
+// merkleReader reads whole blocks, and only hands them out once their hash
+// matches.
+type merkleReader struct {
+	r        io.Reader
+	leaves   [][sha256.Size]byte
+	blockNum int64
+	buf      []byte
+	out      []byte
+	left     int64
+	err      error
+}
+
+func (m *merkleReader) Read(p []byte) (n int, err error) {
+	if len(m.out) == 0 {
+		if m.err != nil {
+			return 0, m.err
+		}
+		m.out, m.err = m.readBlock()
+		if m.err != nil {
+			return 0, m.err
+		}
+	}
+	n = copy(p, m.out)
+	m.out = m.out[n:]
+	return n, nil
+}
+
+func (m *merkleReader) readBlock() ([]byte, error) {
+	if len(m.leaves) == 0 {
+		return nil, io.EOF
+	}
+	block := m.buf
+	if int64(len(block)) > m.left {
+		block = block[:m.left]
+	}
+	_, err := io.ReadFull(m.r, block)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if merkleLeaf(block) != m.leaves[0] {
+		return nil, IntegrityError.New("block %d doesn't match its hash",
+			m.blockNum)
+	}
+	m.leaves = m.leaves[1:]
+	m.left -= int64(len(block))
+	m.blockNum++
+	return block, nil
+}
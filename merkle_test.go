@@ -0,0 +1,159 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jtolds/eestream/ranger"
+)
+
+func buildMerkleTree(t *testing.T, data []byte, blockSize int) *MerkleTree {
+	m := NewMerkleHasher(blockSize)
+	// write in uneven chunks to cross block boundaries
+	for chunk := data; len(chunk) > 0; {
+		n := 5
+		if n > len(chunk) {
+			n = len(chunk)
+		}
+		m.Write(chunk[:n])
+		chunk = chunk[n:]
+	}
+	tree := m.Tree()
+	buf, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tree2 MerkleTree
+	if err := tree2.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if tree2.Root() != tree.Root() || tree2.Size() != int64(len(data)) {
+		t.Fatalf("merkle tree round trip failed")
+	}
+	return &tree2
+}
+
+func TestMerkleVerify(t *testing.T) {
+	const blockSize = 8
+	for _, size := range []int{0, 1, 8, 9, 24, 59, 64} {
+		data := randData(size)
+		tree := buildMerkleTree(t, data, blockSize)
+		rr, err := MerkleVerify(ranger.ByteRanger(data), tree, tree.Root())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i <= size; i++ {
+			for j := i; j <= size; j++ {
+				read, err := ioutil.ReadAll(rr.Range(int64(i), int64(j-i)))
+				if err != nil {
+					t.Fatalf("size %d, range %d-%d: %v", size, i, j, err)
+				}
+				if !bytes.Equal(read, data[i:j]) {
+					t.Fatalf("size %d, range %d-%d: bad data", size, i, j)
+				}
+			}
+		}
+	}
+}
+
+func TestMerkleTampering(t *testing.T) {
+	const blockSize = 8
+	data := randData(59)
+	tree := buildMerkleTree(t, data, blockSize)
+	root := tree.Root()
+	read := func(rr ranger.Ranger, offset, length int64) error {
+		_, err := ioutil.ReadAll(rr.Range(offset, length))
+		if err != nil && !IntegrityError.Contains(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return err
+	}
+
+	// corrupt data only fails the ranges that touch it
+	tampered := append([]byte(nil), data...)
+	tampered[20] ^= 1
+	rr, err := MerkleVerify(ranger.ByteRanger(tampered), tree, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read(rr, 16, 8) == nil || read(rr, 0, 59) == nil {
+		t.Fatalf("expected reading corrupt data to fail")
+	}
+	if read(rr, 0, 16) != nil || read(rr, 24, 35) != nil {
+		t.Fatalf("expected reading around corrupt data to work")
+	}
+
+	// the tree can't vouch for different data, but only the ranges whose
+	// proofs involve the tampered hashes fail.
+	tree.levels[0][2] = merkleLeaf(tampered[16:24])
+	rr, err = MerkleVerify(ranger.ByteRanger(tampered), tree, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read(rr, 16, 8) == nil || read(rr, 24, 8) == nil {
+		t.Fatalf("expected a tampered leaf to fail")
+	}
+	if read(rr, 32, 27) != nil {
+		t.Fatalf("expected ranges that don't rely on the leaf to work")
+	}
+	tree = buildMerkleTree(t, data, blockSize)
+	tree.levels[1][0][0] ^= 1
+	rr, err = MerkleVerify(ranger.ByteRanger(data), tree, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read(rr, 16, 8) == nil {
+		t.Fatalf("expected a tampered proof node to fail")
+	}
+	if read(rr, 0, 16) != nil {
+		t.Fatalf("expected ranges that don't rely on the node to work")
+	}
+
+	// nor can the right tree vouch for the wrong root
+	tree = buildMerkleTree(t, data, blockSize)
+	rr, err = MerkleVerify(ranger.ByteRanger(data), tree,
+		buildMerkleTree(t, tampered, blockSize).Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read(rr, 0, 8) == nil || read(rr, 40, 19) == nil {
+		t.Fatalf("expected the wrong root to fail")
+	}
+
+	// and changing the tree afterwards doesn't change what's checked
+	rr, err = MerkleVerify(ranger.ByteRanger(tampered), tree, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.levels[0][2] = merkleLeaf(tampered[16:24])
+	if read(rr, 16, 8) == nil {
+		t.Fatalf("expected reading corrupt data to fail")
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	const blockSize = 8
+	for _, size := range []int{1, 8, 9, 24, 59, 64} {
+		tree := buildMerkleTree(t, randData(size), blockSize)
+		count := tree.count()
+		for first := int64(0); first < count; first++ {
+			for end := first + 1; end <= count; end++ {
+				root, leaves := tree.Root(), tree.levels[0][first:end]
+				proof := tree.Proof(first, end)
+				if !verifyMerkleRange(root, count, first, leaves, proof) {
+					t.Fatalf("size %d, blocks %d-%d: proof failed", size, first,
+						end)
+				}
+				if len(proof) > 0 &&
+					verifyMerkleRange(root, count, first, leaves, proof[1:]) {
+					t.Fatalf("size %d, blocks %d-%d: short proof passed", size,
+						first, end)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"crypto/rand"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeySaltSize is the size of a KeySalt.
+const KeySaltSize = 16
+
+// A KeySalt is the salt a key is derived from a passphrase with. It isn't
+// secret, and is stored in the PieceHeader so the key can be derived again.
+type KeySalt [KeySaltSize]byte
+
+// NewKeySalt returns a random KeySalt.
+func NewKeySalt() (salt KeySalt, err error) {
+	_, err = rand.Read(salt[:])
+	return salt, Error.Wrap(err)
+}
+
+// scrypt cost parameters. Changing them changes every key derived from a
+// passphrase, so they can only change along with the piece version.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// PassphraseKey derives a KeySize key from passphrase and salt with scrypt,
+// which is deliberately slow and memory hungry so that passphrases are
+// expensive to guess.
+func PassphraseKey(passphrase []byte, salt KeySalt) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, Error.New("empty passphrase")
+	}
+	key, err := scrypt.Key(passphrase, salt[:], scryptN, scryptR, scryptP,
+		KeySize)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	return key, nil
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPassphraseKey(t *testing.T) {
+	salt1, err := NewKeySalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt2, err := NewKeySalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(passphrase string, salt KeySalt) []byte {
+		key, err := PassphraseKey([]byte(passphrase), salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(key) != KeySize {
+			t.Fatalf("unexpected key size %d", len(key))
+		}
+		return key
+	}
+	if !bytes.Equal(key("hunter2", salt1), key("hunter2", salt1)) {
+		t.Fatalf("key derivation isn't deterministic")
+	}
+	if bytes.Equal(key("hunter2", salt1), key("hunter2", salt2)) {
+		t.Fatalf("salt had no effect")
+	}
+	if bytes.Equal(key("hunter2", salt1), key("hunter3", salt1)) {
+		t.Fatalf("passphrase had no effect")
+	}
+	if _, err := PassphraseKey(nil, salt1); err == nil {
+		t.Fatalf("expected an empty passphrase to fail")
+	}
+}
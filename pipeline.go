@@ -0,0 +1,255 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jtolds/eestream/ranger"
+	"github.com/vivint/infectious"
+)
+
+// PipelineConfig defines the stages data goes through on its way to being
+// erasure coded. It is written as a spec string with the stages in the
+// order they are applied when encoding, such as
+//
+//	pad,secretbox,rs:20/40@4096
+//
+// which pads the data, encrypts it with secretbox, then Reed-Solomon encodes
+// it into 40 pieces of 4096 byte blocks, any 20 of which can rebuild it.
+type PipelineConfig struct {
+	// Pad pads the data to a whole number of blocks. Without it, the data
+	// must already be a multiple of the block size.
+	Pad bool
+	// Cipher is "secretbox", "aesgcm", or "" for no encryption.
+	Cipher string
+	// Required and Total are the Reed-Solomon parameters.
+	Required, Total int
+	// PieceBlockSize is the size of the erasure coded blocks in each piece.
+	PieceBlockSize int
+}
+
+type cipherConstructor func(key []byte, prefix NoncePrefix,
+	encryptedBlockSize int) (Transformer, error)
+
+var pipelineCiphers = map[string]cipherConstructor{
+	"secretbox": NewSecretboxEncrypter,
+	"aesgcm":    NewAESGCMEncrypter,
+}
+
+// ParsePipelineSpec parses a spec string into a PipelineConfig.
+func ParsePipelineSpec(spec string) (config PipelineConfig, err error) {
+	return config, config.UnmarshalText([]byte(spec))
+}
+
+// String returns the spec string of c.
+func (c PipelineConfig) String() string {
+	var stages []string
+	if c.Pad {
+		stages = append(stages, "pad")
+	}
+	if c.Cipher != "" {
+		stages = append(stages, c.Cipher)
+	}
+	stages = append(stages, fmt.Sprintf("rs:%d/%d@%d",
+		c.Required, c.Total, c.PieceBlockSize))
+	return strings.Join(stages, ",")
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (c PipelineConfig) MarshalText() ([]byte, error) {
+	return []byte(c.String()), c.validate()
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (c *PipelineConfig) UnmarshalText(text []byte) error {
+	stages := strings.Split(string(text), ",")
+	var config PipelineConfig
+	last := len(stages) - 1
+	for i, stage := range stages {
+		switch {
+		case stage == "pad" && i == 0:
+			config.Pad = true
+		case pipelineCiphers[stage] != nil && i < last && config.Cipher == "":
+			config.Cipher = stage
+		case strings.HasPrefix(stage, "rs:") && i == last:
+			_, err := fmt.Sscanf(stage, "rs:%d/%d@%d", &config.Required,
+				&config.Total, &config.PieceBlockSize)
+			if err != nil || fmt.Sprintf("rs:%d/%d@%d", config.Required,
+				config.Total, config.PieceBlockSize) != stage {
+				return Error.New("invalid pipeline stage %q", stage)
+			}
+		default:
+			return Error.New("unexpected pipeline stage %q in %q", stage, text)
+		}
+	}
+	if config.PieceBlockSize == 0 {
+		return Error.New("pipeline %q doesn't end with an rs stage", text)
+	}
+	*c = config
+	return c.validate()
+}
+
+func (c PipelineConfig) validate() error {
+	if c.Cipher != "" && pipelineCiphers[c.Cipher] == nil {
+		return Error.New("unknown cipher %q", c.Cipher)
+	}
+	if c.Required < 1 || c.Total < c.Required || c.Total > 256 {
+		return Error.New("invalid rs parameters %d/%d", c.Required, c.Total)
+	}
+	if c.PieceBlockSize < 1 {
+		return Error.New("invalid piece block size %d", c.PieceBlockSize)
+	}
+	return nil
+}
+
+// A Pipeline turns data into erasure coded pieces and back, as defined by a
+// PipelineConfig, so that both directions are assembled the same way.
+type Pipeline struct {
+	config    PipelineConfig
+	es        ErasureScheme
+	prefix    NoncePrefix
+	encrypter Transformer
+	decrypter Transformer
+}
+
+// NewPipeline returns the Pipeline for config. key and prefix are the
+// cipher's key and NoncePrefix, and are ignored if config has no cipher.
+func NewPipeline(config PipelineConfig, key []byte, prefix NoncePrefix) (
+	*Pipeline, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	fc, err := infectious.NewFEC(config.Required, config.Total)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	p := &Pipeline{
+		config: config,
+		es:     NewRSScheme(fc, config.PieceBlockSize),
+		prefix: prefix,
+	}
+	if config.Cipher != "" {
+		// every encrypted block lines up with a block of one piece, so a
+		// small read only has to decrypt data from the pieces that hold it.
+		p.encrypter, err = pipelineCiphers[config.Cipher](key, prefix,
+			config.PieceBlockSize)
+		if err != nil {
+			return nil, err
+		}
+		p.decrypter, err = Invert(p.encrypter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Config returns the PipelineConfig p was made from.
+func (p *Pipeline) Config() PipelineConfig {
+	return p.config
+}
+
+// ErasureScheme returns the ErasureScheme of the pipeline's rs stage.
+func (p *Pipeline) ErasureScheme() ErasureScheme {
+	return p.es
+}
+
+// BlockSize is the size of the plaintext in each block of a piece.
+func (p *Pipeline) BlockSize() int {
+	if p.encrypter != nil {
+		return p.encrypter.InBlockSize()
+	}
+	return p.es.EncodedBlockSize()
+}
+
+// padBlockSize is what the plaintext is padded to a multiple of, so it
+// fills a whole number of erasure coded blocks.
+func (p *Pipeline) padBlockSize() int {
+	return p.BlockSize() * p.es.RequiredCount()
+}
+
+// Manifest returns the Manifest of data of plaintextSize bytes encoded by p,
+// or -1 if the size isn't known yet.
+func (p *Pipeline) Manifest(plaintextSize int64) (*Manifest, error) {
+	m, err := NewManifest(p.es, plaintextSize)
+	if err != nil {
+		return nil, err
+	}
+	m.Pipeline = p.config.String()
+	m.NoncePrefix = p.prefix
+	if p.config.Pad && plaintextSize >= 0 {
+		m.Padding = len(makePadding(plaintextSize, p.padBlockSize()))
+	}
+	return m, nil
+}
+
+// PieceHeader returns the PieceHeader for the first piece of data of
+// plaintextSize bytes encoded by p, which carries p.Manifest(plaintextSize).
+func (p *Pipeline) PieceHeader(plaintextSize int64) (*PieceHeader, error) {
+	m, err := p.Manifest(plaintextSize)
+	if err != nil {
+		return nil, err
+	}
+	return &PieceHeader{Manifest: *m}, nil
+}
+
+// EncodeReader runs the data in r through every stage of the pipeline and
+// returns the Readers of the pieces, as EncodeReaderContext does.
+func (p *Pipeline) EncodeReader(ctx context.Context, r io.Reader,
+	opts EncoderOptions) []io.Reader {
+	if p.config.Pad {
+		r = PadReader(r, p.padBlockSize())
+	}
+	if p.encrypter != nil {
+		r = TransformReaderContext(ctx, r, p.encrypter, 0)
+	}
+	return EncodeReaderContext(ctx, r, p.es, opts)
+}
+
+// Decode erasure decodes the pieces in rrs, as DecodeWithOptions does, and
+// undoes the rest of the pipeline. m is the Manifest the data was encoded
+// with, or nil if it isn't known.
+func (p *Pipeline) Decode(rrs map[int]ranger.Ranger, m *Manifest,
+	opts DecoderOptions) (ranger.Ranger, error) {
+	rr, err := DecodeWithOptions(rrs, p.es, opts)
+	if err != nil {
+		return nil, err
+	}
+	return p.DecodeRanger(rr, m)
+}
+
+// DecodeRanger undoes every stage of the pipeline before the rs stage on rr,
+// which is what the pieces erasure decode to, such as the Ranger returned by
+// DecodePieces. If m is nil or doesn't know the plaintext size, the padding
+// has to be read from the end of the data to find it.
+func (p *Pipeline) DecodeRanger(rr ranger.Ranger, m *Manifest) (
+	ranger.Ranger, error) {
+	var err error
+	if p.decrypter != nil {
+		rr, err = Transform(rr, p.decrypter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m == nil || m.PlaintextSize < 0 {
+		if p.config.Pad {
+			return UnpadSlow(rr)
+		}
+		return rr, nil
+	}
+	padding := 0
+	if p.config.Pad {
+		padding = m.Padding
+	}
+	if m.PlaintextSize+int64(padding) != rr.Size() {
+		return nil, Error.New("unexpected size %d, expected %d plus %d "+
+			"bytes of padding", rr.Size(), m.PlaintextSize, padding)
+	}
+	return Unpad(rr, padding)
+}
@@ -0,0 +1,252 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jtolds/eestream/ranger"
+)
+
+// newTestPipeline returns a Pipeline for spec with a random key.
+func newTestPipeline(tb testing.TB, spec string) *Pipeline {
+	config, err := ParsePipelineSpec(spec)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	p, err := NewPipeline(config, randData(KeySize), NoncePrefix{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+// encodePipeline encodes data with p and returns every piece.
+func encodePipeline(tb testing.TB, p *Pipeline, data []byte) (
+	rrs map[int]ranger.Ranger) {
+	// every erasure coded block holds padBlockSize bytes of plaintext, and
+	// padding may add a block.
+	lookahead := len(data)/p.padBlockSize() + 2
+	readers := p.EncodeReader(context.Background(), bytes.NewReader(data),
+		EncoderOptions{Lookahead: lookahead})
+	rrs = map[int]ranger.Ranger{}
+	for i, r := range readers {
+		piece, err := ioutil.ReadAll(r)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		rrs[i] = ranger.ByteRanger(piece)
+	}
+	return rrs
+}
+
+func TestPipelineSpec(t *testing.T) {
+	for _, spec := range []string{
+		"pad,secretbox,rs:20/40@4096",
+		"pad,aesgcm,rs:2/4@64",
+		"secretbox,rs:1/1@1",
+		"pad,rs:3/5@128",
+		"rs:3/5@128",
+	} {
+		config, err := ParsePipelineSpec(spec)
+		if err != nil {
+			t.Fatalf("%q: %v", spec, err)
+		}
+		if config.String() != spec {
+			t.Fatalf("%q became %q", spec, config.String())
+		}
+	}
+	for _, spec := range []string{
+		"",
+		"pad",
+		"secretbox,pad,rs:20/40@4096",
+		"pad,secretbox,aesgcm,rs:20/40@4096",
+		"pad,rot13,rs:20/40@4096",
+		"rs:20/40@4096,pad",
+		"pad,rs:20/40",
+		"pad,rs:20/40@4096x",
+		"pad,rs:40/20@4096",
+		"pad,rs:20/40@0",
+	} {
+		if _, err := ParsePipelineSpec(spec); err == nil {
+			t.Fatalf("expected %q to fail", spec)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	key := randData(KeySize)
+	prefix, err := NewNoncePrefix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{
+		"pad,secretbox,rs:3/5@64",
+		"pad,aesgcm,rs:3/5@64",
+		"pad,rs:3/5@64",
+	} {
+		config, err := ParsePipelineSpec(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := NewPipeline(config, key, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := randData(1000)
+		rrs := encodePipeline(t, p, data)
+		// drop a couple of pieces
+		delete(rrs, 0)
+		delete(rrs, 1)
+
+		// a second Pipeline from the same spec decodes what the first encoded
+		p, err = NewPipeline(config, key, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := p.Manifest(int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range []*Manifest{m, nil} {
+			rr, err := p.Decode(rrs, m, DecoderOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := ioutil.ReadAll(rr.Range(0, rr.Size()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, decoded) {
+				t.Fatalf("%q: round trip failed", spec)
+			}
+		}
+
+		h, err := p.PieceHeader(int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Pipeline != spec || h.NoncePrefix != prefix {
+			t.Fatalf("unexpected header %#v", h)
+		}
+	}
+}
+
+func TestPipelineSmallRange(t *testing.T) {
+	p := newTestPipeline(t, "pad,secretbox,rs:4/8@64")
+	data := randData(1000)
+	m, err := p.Manifest(int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrs := encodePipeline(t, p, data)
+	for i, rr := range rrs {
+		rrs[i] = &touchedRanger{Ranger: rr}
+	}
+	rr, err := p.Decode(rrs, m, DecoderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the third block of plaintext is all in piece 2
+	offset := int64(2*p.BlockSize() + 5)
+	got, err := ioutil.ReadAll(rr.Range(offset, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[offset:offset+10]) {
+		t.Fatalf("wrong data")
+	}
+	for i, rr := range rrs {
+		if rr.(*touchedRanger).touched != (i == 2) {
+			t.Fatalf("unexpected read from piece %d", i)
+		}
+	}
+}
+
+// benchmarkPipeline encodes size bytes with the default cmd/store pipeline,
+// returning the Pipeline and the pieces.
+func benchmarkPipeline(b *testing.B, size int) (*Pipeline, []byte,
+	map[int]ranger.Ranger) {
+	p := newTestPipeline(b, "pad,secretbox,rs:20/40@4096")
+	data := randData(size)
+	return p, data, encodePipeline(b, p, data)
+}
+
+func BenchmarkPipelineEncode(b *testing.B) {
+	p, data, _ := benchmarkPipeline(b, 4<<20)
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				readers := p.EncodeReader(context.Background(),
+					bytes.NewReader(data),
+					EncoderOptions{Workers: workers, Lookahead: 2 * workers})
+				errs := make(chan error, len(readers))
+				for _, r := range readers {
+					go func(r io.Reader) {
+						_, err := io.Copy(ioutil.Discard, r)
+						errs <- err
+					}(r)
+				}
+				for range readers {
+					if err := <-errs; err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPipelineDecode(b *testing.B) {
+	p, data, rrs := benchmarkPipeline(b, 4<<20)
+	m, err := p.Manifest(int64(len(data)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	// without piece 0, every block is erasure decoded.
+	decodeRRs := map[int]ranger.Ranger{}
+	for i, rr := range rrs {
+		if i != 0 {
+			decodeRRs[i] = rr
+		}
+	}
+	for _, test := range []struct {
+		name string
+		rrs  map[int]ranger.Ranger
+	}{{"stitched", rrs}, {"decoded", decodeRRs}} {
+		rr, err := p.Decode(test.rrs, m, DecoderOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		// small reads, such as from a bufio.Reader, shouldn't cost more
+		// than big ones.
+		for _, readSize := range []int{512, 32 * 1024} {
+			b.Run(fmt.Sprintf("%s/read=%d", test.name, readSize),
+				func(b *testing.B) {
+					b.SetBytes(int64(len(data)))
+					b.ReportAllocs()
+					buf := make([]byte, readSize)
+					for i := 0; i < b.N; i++ {
+						r := rr.Range(0, rr.Size())
+						for {
+							_, err := r.Read(buf)
+							if err == io.EOF {
+								break
+							}
+							if err != nil {
+								b.Fatal(err)
+							}
+						}
+					}
+				})
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"sync"
+)
+
+// blockPools holds a pool of buffers for every block size in use, so the
+// encode, transform and decode stages can reuse blocks instead of allocating
+// new ones for every block and every Range.
+var blockPools = struct {
+	mtx   sync.Mutex
+	pools map[int]*sync.Pool
+}{pools: map[int]*sync.Pool{}}
+
+// blockHeaders holds the *[]byte the pools store buffers in once they're
+// empty, so putting a buffer back doesn't allocate a new one every time.
+var blockHeaders = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+func blockPool(size int) *sync.Pool {
+	blockPools.mtx.Lock()
+	defer blockPools.mtx.Unlock()
+	pool := blockPools.pools[size]
+	if pool == nil {
+		pool = &sync.Pool{New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}}
+		blockPools.pools[size] = pool
+	}
+	return pool
+}
+
+// getBlock returns a buffer of size bytes. Its contents are undefined.
+func getBlock(size int) []byte {
+	header := blockPool(size).Get().(*[]byte)
+	buf := *header
+	*header = nil
+	blockHeaders.Put(header)
+	return buf
+}
+
+// putBlock returns a buffer from getBlock to be reused. buf must not be used
+// afterwards, by the caller or anyone it was shared with.
+func putBlock(buf []byte) {
+	if buf == nil {
+		return
+	}
+	header := blockHeaders.Get().(*[]byte)
+	*header = buf[:cap(buf)]
+	blockPool(cap(buf)).Put(header)
+}
+
+// putBlocks is putBlock for every buffer in bufs.
+func putBlocks(bufs [][]byte) {
+	for _, buf := range bufs {
+		putBlock(buf)
+	}
+}
@@ -47,7 +47,8 @@ func ServeContent(w http.ResponseWriter, r *http.Request, name string,
 				amount = sniffLen
 			}
 			// TODO: cache this somewhere so we don't have to pull it out again
-			n, _ := io.ReadFull(content.Range(0, amount), buf[:])
+			n, _ := io.ReadFull(RangeContext(r.Context(), content, 0, amount),
+				buf[:])
 			ctype = http.DetectContentType(buf[:n])
 		}
 		w.Header().Set("Content-Type", ctype)
@@ -65,7 +66,7 @@ func ServeContent(w http.ResponseWriter, r *http.Request, name string,
 	// handle Content-Range header.
 	sendSize := size
 	sendContent := func() io.Reader {
-		return content.Range(0, size)
+		return RangeContext(r.Context(), content, 0, size)
 	}
 
 	ranges, err := parseRange(rangeReq, size)
@@ -97,7 +98,9 @@ func ServeContent(w http.ResponseWriter, r *http.Request, name string,
 		// A response to a request for a single range MUST NOT
 		// be sent using the multipart/byteranges media type."
 		ra := ranges[0]
-		sendContent = func() io.Reader { return content.Range(ra.start, ra.length) }
+		sendContent = func() io.Reader {
+			return RangeContext(r.Context(), content, ra.start, ra.length)
+		}
 		sendSize = ra.length
 		code = http.StatusPartialContent
 		w.Header().Set("Content-Range", ra.contentRange(size))
@@ -119,7 +122,8 @@ func ServeContent(w http.ResponseWriter, r *http.Request, name string,
 					pw.CloseWithError(err)
 					return
 				}
-				partReader := content.Range(ra.start, ra.length)
+				partReader := RangeContext(r.Context(), content, ra.start,
+					ra.length)
 				if _, err := io.Copy(part, partReader); err != nil {
 					pw.CloseWithError(err)
 					return
@@ -0,0 +1,50 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ranger
+
+import (
+	"context"
+	"io"
+)
+
+// A ContextRanger is a Ranger whose Readers can be cancelled with a context.
+type ContextRanger interface {
+	Ranger
+
+	// RangeContext is like Range, but the returned Reader stops reading and
+	// fails with ctx.Err() once ctx is done.
+	RangeContext(ctx context.Context, offset, length int64) io.Reader
+}
+
+// RangeContext calls rr.RangeContext if rr is a ContextRanger. Otherwise it
+// returns rr.Range wrapped with ContextReader.
+func RangeContext(ctx context.Context, rr Ranger,
+	offset, length int64) io.Reader {
+	if cr, ok := rr.(ContextRanger); ok {
+		return cr.RangeContext(ctx, offset, length)
+	}
+	return ContextReader(ctx, rr.Range(offset, length))
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// ContextReader returns a Reader that reads from r until ctx is done, and
+// then fails with ctx.Err(). A Read that is already blocked in r is not
+// interrupted.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r
+	}
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (c *contextReader) Read(p []byte) (n int, err error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
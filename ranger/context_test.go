@@ -0,0 +1,36 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package ranger
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRangeContext(t *testing.T) {
+	data := []byte("abcdefghijkl")
+	for _, rr := range []Ranger{
+		ByteRanger(data),
+		ReaderAtRanger(bytes.NewReader(data), int64(len(data))),
+		Concat(ByteRanger(data[:5]), ByteRanger(data[5:])),
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		read, err := ioutil.ReadAll(RangeContext(ctx, rr, 3, 6))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if !bytes.Equal(read, data[3:9]) {
+			t.Fatalf("invalid subrange: %#v", string(read))
+		}
+
+		r := RangeContext(ctx, rr, 0, rr.Size())
+		cancel()
+		_, err = ioutil.ReadAll(r)
+		if err != context.Canceled {
+			t.Fatalf("expected canceled, got %v", err)
+		}
+	}
+}
@@ -5,6 +5,7 @@ package ranger
 
 import (
 	"bytes"
+	"context"
 	"io"
 )
 
@@ -55,17 +56,22 @@ func (c *concatReader) Size() int64 {
 }
 
 func (c *concatReader) Range(offset, length int64) io.Reader {
+	return c.RangeContext(context.Background(), offset, length)
+}
+
+func (c *concatReader) RangeContext(ctx context.Context,
+	offset, length int64) io.Reader {
 	r1Size := c.r1.Size()
 	if offset+length <= r1Size {
-		return c.r1.Range(offset, length)
+		return RangeContext(ctx, c.r1, offset, length)
 	}
 	if offset >= r1Size {
-		return c.r2.Range(offset-r1Size, length)
+		return RangeContext(ctx, c.r2, offset-r1Size, length)
 	}
 	return io.MultiReader(
-		c.r1.Range(offset, r1Size-offset),
+		RangeContext(ctx, c.r1, offset, r1Size-offset),
 		LazyReader(func() io.Reader {
-			return c.r2.Range(0, length-(r1Size-offset))
+			return RangeContext(ctx, c.r2, 0, length-(r1Size-offset))
 		}))
 }
 
@@ -131,3 +137,8 @@ func (s *subrange) Size() int64 {
 func (s *subrange) Range(offset, length int64) io.Reader {
 	return s.r.Range(offset+s.offset, length)
 }
+
+func (s *subrange) RangeContext(ctx context.Context,
+	offset, length int64) io.Reader {
+	return RangeContext(ctx, s.r, offset+s.offset, length)
+}
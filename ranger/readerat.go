@@ -4,6 +4,7 @@
 package ranger
 
 import (
+	"context"
 	"io"
 )
 
@@ -25,21 +26,30 @@ func (r *readerAtRanger) Size() int64 {
 }
 
 type readerAtReader struct {
+	ctx            context.Context
 	r              io.ReaderAt
 	offset, length int64
 }
 
 func (r *readerAtRanger) Range(offset, length int64) io.Reader {
+	return r.RangeContext(context.Background(), offset, length)
+}
+
+func (r *readerAtRanger) RangeContext(ctx context.Context,
+	offset, length int64) io.Reader {
 	if offset < 0 {
 		return FatalReader(Error.New("negative offset"))
 	}
 	if offset+length > r.size {
 		return FatalReader(Error.New("buffer runoff"))
 	}
-	return &readerAtReader{r: r.r, offset: offset, length: length}
+	return &readerAtReader{ctx: ctx, r: r.r, offset: offset, length: length}
 }
 
 func (r *readerAtReader) Read(p []byte) (n int, err error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
 	if r.length == 0 {
 		return 0, io.EOF
 	}
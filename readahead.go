@@ -0,0 +1,148 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"context"
+	"io"
+)
+
+// readAheadReader reads blocks from r on its own goroutine, up to count
+// blocks ahead of its caller, so fetching and decoding the next blocks
+// overlaps with the caller consuming the current one. At most count+1
+// blocks are buffered. If count is less than 1, reads go straight to r.
+type readAheadReader struct {
+	ctx       context.Context
+	cancel    func()
+	r         io.ReadCloser
+	blockSize int
+	count     int
+	blocks    chan readAheadBlock
+	free      chan []byte
+	done      chan struct{}
+	buf       []byte
+	outbuf    []byte
+	err       error
+}
+
+type readAheadBlock struct {
+	data []byte
+	err  error
+}
+
+// readAhead returns a Reader of r that reads count blocks of blockSize ahead.
+// The goroutine doing the reading starts with the first Read, and exits once
+// r is done or ctx is. cancel must cancel ctx, and is called by Close, which
+// also closes r.
+func readAhead(ctx context.Context, cancel func(), r io.ReadCloser,
+	blockSize, count int) io.ReadCloser {
+	return &readAheadReader{
+		ctx:       ctx,
+		cancel:    cancel,
+		r:         r,
+		blockSize: blockSize,
+		count:     count,
+	}
+}
+
+func (ra *readAheadReader) start() {
+	ra.blocks = make(chan readAheadBlock, ra.count)
+	ra.free = make(chan []byte, ra.count+1)
+	ra.done = make(chan struct{})
+	for i := 0; i < ra.count+1; i++ {
+		ra.free <- getBlock(ra.blockSize)
+	}
+	go ra.fill()
+}
+
+// fill reads blocks into free buffers until r fails or ends.
+func (ra *readAheadReader) fill() {
+	defer close(ra.done)
+	for {
+		var buf []byte
+		select {
+		case buf = <-ra.free:
+		case <-ra.ctx.Done():
+			return
+		}
+		n, err := io.ReadFull(ra.r, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		select {
+		case ra.blocks <- readAheadBlock{data: buf[:n], err: err}:
+		case <-ra.ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (ra *readAheadReader) Read(p []byte) (n int, err error) {
+	if ra.count < 1 {
+		return ra.r.Read(p)
+	}
+	if err := ra.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if ra.blocks == nil {
+		ra.start()
+	}
+	for len(ra.outbuf) <= 0 {
+		if ra.err != nil {
+			select {
+			case <-ra.done:
+				ra.release()
+			default:
+			}
+			return 0, ra.err
+		}
+		if ra.buf != nil {
+			ra.free <- ra.buf[:ra.blockSize]
+			ra.buf = nil
+		}
+		select {
+		case b := <-ra.blocks:
+			ra.buf, ra.outbuf, ra.err = b.data, b.data, b.err
+		case <-ra.ctx.Done():
+			ra.err = ra.ctx.Err()
+		}
+	}
+	n = copy(p, ra.outbuf)
+	ra.outbuf = ra.outbuf[n:]
+	return n, nil
+}
+
+// release returns the buffers to the pool. It must only be called once fill
+// has exited.
+func (ra *readAheadReader) release() {
+	putBlock(ra.buf)
+	ra.buf, ra.outbuf = nil, nil
+	for {
+		select {
+		case buf := <-ra.free:
+			putBlock(buf)
+		case b := <-ra.blocks:
+			putBlock(b.data)
+		default:
+			return
+		}
+	}
+}
+
+// Close stops reading ahead, waiting for the goroutine doing it to exit, and
+// closes r.
+func (ra *readAheadReader) Close() error {
+	ra.cancel()
+	if ra.done != nil {
+		<-ra.done
+		ra.release()
+	}
+	if ra.err == nil || ra.err == io.EOF {
+		ra.err = Error.New("decoder closed")
+	}
+	return ra.r.Close()
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/jtolds/eestream/ranger"
+	"github.com/vivint/infectious"
+)
+
+func TestDecodeReadAhead(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 64)
+	data := randData(rs.DecodedBlockSize() * 20)
+	pieces := encodePieces(t, data, rs)
+	opts := DecoderOptions{ReadAhead: 3}
+
+	readerMap := map[int]io.Reader{}
+	for i, piece := range pieces {
+		readerMap[i] = bytes.NewReader(piece)
+	}
+	data2, err := ioutil.ReadAll(DecodeReadersWithOptions(readerMap, rs, opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Fatalf("decode with read ahead failed")
+	}
+
+	rrs := map[int]ranger.Ranger{}
+	for i, piece := range pieces {
+		// leave out a data piece, so the blocks are erasure decoded.
+		if i != 1 {
+			rrs[i] = ranger.ByteRanger(piece)
+		}
+	}
+	rr, err := DecodeWithOptions(rrs, rs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct{ offset, length int64 }{
+		{0, rr.Size()}, {10, 1000}, {100, 10}, {256, 0},
+	} {
+		data2, err := ioutil.ReadAll(rr.Range(r.offset, r.length))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[r.offset:r.offset+r.length], data2) {
+			t.Fatalf("%d+%d: range with read ahead failed", r.offset, r.length)
+		}
+	}
+}
+
+// gatedReader waits for a token from gate before every Read.
+type gatedReader struct {
+	r    io.Reader
+	gate chan struct{}
+}
+
+func (g *gatedReader) Read(p []byte) (n int, err error) {
+	<-g.gate
+	return g.r.Read(p)
+}
+
+func TestReadAheadBound(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 64)
+	pieces := encodePieces(t, randData(rs.DecodedBlockSize()*20), rs)
+	readerMap := map[int]io.Reader{}
+	gate := make(chan struct{})
+	readerMap[0] = &gatedReader{r: bytes.NewReader(pieces[0]), gate: gate}
+	for i := 1; i < len(pieces); i++ {
+		readerMap[i] = bytes.NewReader(pieces[i])
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := DecodeReadersContext(ctx, readerMap, rs,
+		DecoderOptions{ReadAhead: 3})
+	defer r.Close()
+	ra := r.(*readAheadReader)
+
+	// the block being read plus 3 more are fetched without any more reads.
+	// every block of piece 0 is a single Read, so each takes one token.
+	read := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		read <- err
+	}()
+	for i := 0; i < 4; i++ {
+		gate <- struct{}{}
+	}
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+
+	// once the 3 blocks are waiting, every buffer is in use, and there can't
+	// be another read until one is freed.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ra.blocks) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d blocks were read ahead", len(ra.blocks))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case gate <- struct{}{}:
+		t.Fatalf("read more than 3 blocks ahead")
+	default:
+	}
+
+	// finishing the first block frees a buffer for the next one.
+	_, err = io.ReadFull(r, make([]byte, rs.DecodedBlockSize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate <- struct{}{}
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// A PublicKey is an X25519 public key that data keys can be wrapped to, so
+// that whoever holds the matching Identity can decrypt the data without
+// knowing any shared secret.
+type PublicKey [32]byte
+
+// MarshalText implements encoding.TextMarshaler.
+func (k PublicKey) MarshalText() ([]byte, error) {
+	return marshalKey(k[:]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (k *PublicKey) UnmarshalText(text []byte) error {
+	return unmarshalKey(k[:], text)
+}
+
+// An Identity is an X25519 key pair that can unwrap data keys wrapped to its
+// PublicKey.
+type Identity struct {
+	PublicKey  PublicKey
+	privateKey [32]byte
+}
+
+// NewIdentity returns a random Identity.
+func NewIdentity() (*Identity, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	return &Identity{PublicKey: *pub, privateKey: *priv}, nil
+}
+
+// MarshalText implements encoding.TextMarshaler. The text contains the
+// private key, so it has to be kept secret.
+func (id *Identity) MarshalText() ([]byte, error) {
+	return marshalKey(id.privateKey[:]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (id *Identity) UnmarshalText(text []byte) error {
+	err := unmarshalKey(id.privateKey[:], text)
+	if err != nil {
+		return err
+	}
+	pub, err := curve25519.X25519(id.privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return Error.Wrap(err)
+	}
+	copy(id.PublicKey[:], pub)
+	return nil
+}
+
+func marshalKey(key []byte) []byte {
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(key)))
+	base64.StdEncoding.Encode(text, key)
+	return text
+}
+
+func unmarshalKey(dst, text []byte) error {
+	key := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(key, text)
+	if err != nil {
+		return Error.New("invalid key: %v", err)
+	}
+	if n != len(dst) {
+		return Error.New("invalid key length %d, expected %d", n, len(dst))
+	}
+	copy(dst, key[:n])
+	return nil
+}
+
+// WrapKeyForRecipient encrypts dataKey to recipient with an anonymous
+// nacl/box, so only recipient's Identity can unwrap it.
+func WrapKeyForRecipient(recipient PublicKey, dataKey []byte) (
+	WrappedKey, error) {
+	data, err := box.SealAnonymous(nil, dataKey, (*[32]byte)(&recipient),
+		rand.Reader)
+	if err != nil {
+		return WrappedKey{}, Error.Wrap(err)
+	}
+	return WrappedKey{Type: KeyWrapBox, Data: data}, nil
+}
+
+// UnwrapKeyWithIdentity returns the data key in the first of keys that was
+// wrapped to id.
+func UnwrapKeyWithIdentity(id *Identity, keys []WrappedKey) ([]byte, error) {
+	for _, w := range keys {
+		if w.Type != KeyWrapBox {
+			continue
+		}
+		dataKey, ok := box.OpenAnonymous(nil, w.Data,
+			(*[32]byte)(&id.PublicKey), &id.privateKey)
+		if ok {
+			return dataKey, nil
+		}
+	}
+	return nil, Error.New("no data key wrapped to this identity")
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRecipients(t *testing.T) {
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eve, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek := randData(KeySize)
+	keys := []WrappedKey{}
+	for _, wrap := range []func() (WrappedKey, error){
+		func() (WrappedKey, error) { return WrapKey(kek, dataKey) },
+		func() (WrappedKey, error) {
+			return WrapKeyForRecipient(alice.PublicKey, dataKey)
+		},
+		func() (WrappedKey, error) {
+			return WrapKeyForRecipient(bob.PublicKey, dataKey)
+		},
+	} {
+		w, err := wrap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, w)
+	}
+
+	// identities survive being saved and loaded
+	text, err := bob.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bob2 Identity
+	if err := bob2.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if bob2.PublicKey != bob.PublicKey {
+		t.Fatalf("loaded identity has the wrong public key")
+	}
+	text, err = alice.PublicKey.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var alicePub PublicKey
+	if err := alicePub.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if alicePub != alice.PublicKey {
+		t.Fatalf("public key round trip failed")
+	}
+
+	for _, id := range []*Identity{alice, &bob2} {
+		unwrapped, err := UnwrapKeyWithIdentity(id, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(unwrapped, dataKey) {
+			t.Fatalf("unwrapped the wrong key")
+		}
+	}
+	if _, err := UnwrapKeyWithIdentity(eve, keys); err == nil {
+		t.Fatalf("expected unwrapping with another identity to fail")
+	}
+
+	// rotating the shared key leaves recipients alone
+	keys, err = RewrapKey(kek, randData(KeySize), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnwrapKeyWithIdentity(alice, keys); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"github.com/jtolds/eestream/ranger"
+)
+
+// Repair takes a map of surviving erasure piece Rangers, 'rrs', and the
+// ErasureScheme they were encoded with, and returns Rangers for the missing
+// pieces numbered in 'missing'. Piece data is regenerated on demand for just
+// the blocks a Range touches, so a repair can be streamed and resumed from
+// any offset.
+func Repair(rrs map[int]ranger.Ranger, es ErasureScheme, missing []int) (
+	map[int]ranger.Ranger, error) {
+	if len(rrs) < es.RequiredCount() {
+		return nil, Error.New("not enough pieces to repair from")
+	}
+	decoded, err := Decode(rrs, es)
+	if err != nil {
+		return nil, err
+	}
+	repaired := make(map[int]ranger.Ranger, len(missing))
+	for _, num := range missing {
+		if num < 0 || num >= es.TotalCount() {
+			return nil, Error.New("invalid piece number %d", num)
+		}
+		repaired[num], err = Transform(decoded, &pieceEncoder{es: es, num: num})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return repaired, nil
+}
+
+// pieceEncoder is a Transformer that erasure codes decoded blocks and keeps
+// just one of the resulting pieces.
+type pieceEncoder struct {
+	es  ErasureScheme
+	num int
+}
+
+func (p *pieceEncoder) InBlockSize() int  { return p.es.DecodedBlockSize() }
+func (p *pieceEncoder) OutBlockSize() int { return p.es.EncodedBlockSize() }
+
+func (p *pieceEncoder) Transform(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	err := p.es.Encode(in, func(num int, data []byte) {
+		if num == p.num {
+			out = append(out, data...)
+		}
+	})
+	return out, err
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jtolds/eestream/ranger"
+	"github.com/vivint/infectious"
+)
+
+func TestRepair(t *testing.T) {
+	fc, err := infectious.NewFEC(3, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 64)
+	pieces := encodePieces(t, randData(rs.DecodedBlockSize()*5), rs)
+
+	survivors := map[int]ranger.Ranger{}
+	for _, i := range []int{0, 2, 3, 5} {
+		survivors[i] = ranger.ByteRanger(pieces[i])
+	}
+	repaired, err := Repair(survivors, rs, []int{1, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repaired) != 2 {
+		t.Fatalf("unexpected repaired pieces: %v", repaired)
+	}
+
+	for num, rr := range repaired {
+		piece := pieces[num]
+		if rr.Size() != int64(len(piece)) {
+			t.Fatalf("wrong repaired piece size: %d", rr.Size())
+		}
+		// repairs can be done in arbitrary ranges
+		for _, r := range []struct{ offset, length int64 }{
+			{0, rr.Size()}, {0, 1}, {63, 2}, {100, 150}, {rr.Size() - 1, 1},
+		} {
+			data, err := ioutil.ReadAll(rr.Range(r.offset, r.length))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, piece[r.offset:r.offset+r.length]) {
+				t.Fatalf("piece %d repaired wrong at %v", num, r)
+			}
+		}
+	}
+
+	if _, err := Repair(map[int]ranger.Ranger{
+		0: survivors[0], 2: survivors[2]}, rs, []int{1}); err == nil {
+		t.Fatalf("expected repair with too few pieces to fail")
+	}
+}
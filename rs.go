@@ -4,12 +4,18 @@
 package eestream
 
 import (
+	"bytes"
+	"sort"
+	"sync"
+
 	"github.com/vivint/infectious"
 )
 
 type rsScheme struct {
 	fc        *infectious.FEC
 	blockSize int
+	// shares holds *[]infectious.Share for Decode to reuse.
+	shares sync.Pool
 }
 
 // NewRSScheme returns a Reed-Solomon-based ErasureScheme.
@@ -25,11 +31,52 @@ func (s *rsScheme) Encode(input []byte, output func(num int, data []byte)) (
 }
 
 func (s *rsScheme) Decode(out []byte, in map[int][]byte) ([]byte, error) {
+	shares, _ := s.shares.Get().(*[]infectious.Share)
+	if shares == nil {
+		shares = new([]infectious.Share)
+	}
+	for num, data := range in {
+		*shares = append(*shares, infectious.Share{Number: num, Data: data})
+	}
+	out, err := s.fc.Decode(out, *shares)
+	// don't keep the blocks alive just because the slice is pooled.
+	for i := range *shares {
+		(*shares)[i].Data = nil
+	}
+	*shares = (*shares)[:0]
+	s.shares.Put(shares)
+	return out, err
+}
+
+// DecodeAndDetect implements CorruptionDetector. Corrupt pieces are found and
+// corrected with Berlekamp-Welch, so at most (len(in)-RequiredCount())/2 of
+// them can be handled per block.
+func (s *rsScheme) DecodeAndDetect(out []byte, in map[int][]byte) (
+	data []byte, corrupt []int, err error) {
 	shares := make([]infectious.Share, 0, len(in))
 	for num, data := range in {
-		shares = append(shares, infectious.Share{Number: num, Data: data})
+		// Correct fixes shares in place, so work on a copy to compare with.
+		shares = append(shares, infectious.Share{
+			Number: num, Data: append([]byte(nil), data...)})
+	}
+	err = s.fc.Correct(shares)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, share := range shares {
+		if !bytes.Equal(share.Data, in[share.Number]) {
+			corrupt = append(corrupt, share.Number)
+		}
 	}
-	return s.fc.Decode(out, shares)
+	sort.Ints(corrupt)
+	data, err = s.fc.Decode(out, shares)
+	return data, corrupt, err
+}
+
+// Systematic implements SystematicScheme. infectious puts the input in the
+// first RequiredCount shares as is.
+func (s *rsScheme) Systematic() bool {
+	return true
 }
 
 func (s *rsScheme) EncodedBlockSize() int {
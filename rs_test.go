@@ -7,8 +7,10 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"reflect"
 	"testing"
 
+	"github.com/jtolds/eestream/ranger"
 	"github.com/vivint/infectious"
 )
 
@@ -32,3 +34,43 @@ func TestRS(t *testing.T) {
 		t.Fatalf("rs encode/decode failed")
 	}
 }
+
+func TestRSCorruptPieces(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 1024)
+	data := randData(rs.DecodedBlockSize() * 4)
+	pieces := encodePieces(t, data, rs)
+	// flip a byte of piece 3 in block 1, and of piece 0 in block 2
+	pieces[3][1024+17] ^= 0xff
+	pieces[0][2*1024+3] ^= 0x01
+
+	rrs := make(map[int]ranger.Ranger, len(pieces))
+	for i, piece := range pieces {
+		rrs[i] = ranger.ByteRanger(piece)
+	}
+	corrupt := map[int64][]int{}
+	rr, err := DecodeWithOptions(rrs, rs, DecoderOptions{
+		CorruptPieces: func(blockNum int64, pieces []int) {
+			corrupt[blockNum] = pieces
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// start in the middle of block 1 so block numbers have to be counted from
+	// the start of the pieces, not the start of the range.
+	offset := int64(rs.DecodedBlockSize() + 5)
+	data2, err := ioutil.ReadAll(rr.Range(offset, rr.Size()-offset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[offset:], data2) {
+		t.Fatalf("rs decode with corrupt pieces failed")
+	}
+	if len(corrupt) != 2 || !reflect.DeepEqual(corrupt[1], []int{3}) ||
+		!reflect.DeepEqual(corrupt[2], []int{0}) {
+		t.Fatalf("unexpected corrupt pieces: %v", corrupt)
+	}
+}
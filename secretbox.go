@@ -4,14 +4,30 @@
 package eestream
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
+// NoncePrefixSize is the size of a NoncePrefix.
+const NoncePrefixSize = 16
+
+// A NoncePrefix starts every nonce used to encrypt a stream, so streams
+// encrypted with the same key don't reuse nonces. The rest of the nonce is
+// the block number.
+type NoncePrefix [NoncePrefixSize]byte
+
+// NewNoncePrefix returns a random NoncePrefix.
+func NewNoncePrefix() (prefix NoncePrefix, err error) {
+	_, err = rand.Read(prefix[:])
+	return prefix, Error.Wrap(err)
+}
+
 type secretboxEncrypter struct {
 	blockSize int
 	key       [32]byte
+	prefix    NoncePrefix
 }
 
 func setKey(dst *[32]byte, key []byte) error {
@@ -23,13 +39,19 @@ func setKey(dst *[32]byte, key []byte) error {
 }
 
 // NewSecretboxEncrypter returns a Transformer that encrypts the data passing
-// through with key.
-func NewSecretboxEncrypter(key []byte, encryptedBlockSize int) (
-	Transformer, error) {
+// through with key. prefix must be unique for every stream encrypted with
+// key, and is needed again to decrypt it. The Transformer is a
+// FinalBlockTransformer, so the decrypter can tell if the stream was cut
+// short.
+func NewSecretboxEncrypter(key []byte, prefix NoncePrefix,
+	encryptedBlockSize int) (Transformer, error) {
 	if encryptedBlockSize <= secretbox.Overhead {
 		return nil, Error.New("block size too small")
 	}
-	rv := &secretboxEncrypter{blockSize: encryptedBlockSize - secretbox.Overhead}
+	rv := &secretboxEncrypter{
+		blockSize: encryptedBlockSize - secretbox.Overhead,
+		prefix:    prefix,
+	}
 	return rv, setKey(&rv.key, key)
 }
 
@@ -41,32 +63,66 @@ func (s *secretboxEncrypter) OutBlockSize() int {
 	return s.blockSize + secretbox.Overhead
 }
 
-func calcNonce(blockNum int64) *[24]byte {
-	var buf [uint32Size]byte
-	binary.BigEndian.PutUint32(buf[:], uint32(blockNum))
+// finalBlockFlag is set in the block number of a nonce to mark the final
+// block of a stream. Block numbers are never negative, so it can't collide
+// with a real block number.
+const finalBlockFlag = 1 << 63
+
+func calcBlockCounter(blockNum int64, final bool) uint64 {
+	counter := uint64(blockNum)
+	if final {
+		counter |= finalBlockFlag
+	}
+	return counter
+}
+
+func calcNonce(prefix NoncePrefix, blockNum int64, final bool) *[24]byte {
 	var nonce [24]byte
-	copy(nonce[:], buf[1:])
+	copy(nonce[:], prefix[:])
+	binary.BigEndian.PutUint64(nonce[NoncePrefixSize:],
+		calcBlockCounter(blockNum, final))
 	return &nonce
 }
 
+// Inverse implements InvertibleTransformer.
+func (s *secretboxEncrypter) Inverse() Transformer {
+	return &secretboxDecrypter{
+		blockSize: s.blockSize,
+		key:       s.key,
+		prefix:    s.prefix,
+	}
+}
+
 func (s *secretboxEncrypter) Transform(out, in []byte, blockNum int64) (
 	[]byte, error) {
-	return secretbox.Seal(out, in, calcNonce(blockNum), &s.key), nil
+	return secretbox.Seal(out, in, calcNonce(s.prefix, blockNum, false),
+		&s.key), nil
+}
+
+func (s *secretboxEncrypter) TransformFinal(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	return secretbox.Seal(out, in, calcNonce(s.prefix, blockNum, true),
+		&s.key), nil
 }
 
 type secretboxDecrypter struct {
 	blockSize int
 	key       [32]byte
+	prefix    NoncePrefix
 }
 
 // NewSecretboxDecrypter returns a Transformer that decrypts the data passing
-// through with key.
-func NewSecretboxDecrypter(key []byte, encryptedBlockSize int) (
-	Transformer, error) {
+// through with key. prefix must be the NoncePrefix the data was encrypted
+// with.
+func NewSecretboxDecrypter(key []byte, prefix NoncePrefix,
+	encryptedBlockSize int) (Transformer, error) {
 	if encryptedBlockSize <= secretbox.Overhead {
 		return nil, Error.New("block size too small")
 	}
-	rv := &secretboxDecrypter{blockSize: encryptedBlockSize - secretbox.Overhead}
+	rv := &secretboxDecrypter{
+		blockSize: encryptedBlockSize - secretbox.Overhead,
+		prefix:    prefix,
+	}
 	return rv, setKey(&rv.key, key)
 }
 
@@ -78,9 +134,29 @@ func (s *secretboxDecrypter) OutBlockSize() int {
 	return s.blockSize
 }
 
+// Inverse implements InvertibleTransformer.
+func (s *secretboxDecrypter) Inverse() Transformer {
+	return &secretboxEncrypter{
+		blockSize: s.blockSize,
+		key:       s.key,
+		prefix:    s.prefix,
+	}
+}
+
 func (s *secretboxDecrypter) Transform(out, in []byte, blockNum int64) (
 	[]byte, error) {
-	rv, success := secretbox.Open(out, in, calcNonce(blockNum), &s.key)
+	return s.open(out, in, blockNum, false)
+}
+
+func (s *secretboxDecrypter) TransformFinal(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	return s.open(out, in, blockNum, true)
+}
+
+func (s *secretboxDecrypter) open(out, in []byte, blockNum int64,
+	final bool) ([]byte, error) {
+	rv, success := secretbox.Open(out, in, calcNonce(s.prefix, blockNum, final),
+		&s.key)
 	if !success {
 		return nil, Error.New("failed decrypting")
 	}
@@ -21,14 +21,18 @@ func randData(amount int) []byte {
 
 func TestSecretbox(t *testing.T) {
 	key := randData(32)
-	encrypter, err := NewSecretboxEncrypter(key, 4*1024)
+	prefix, err := NewNoncePrefix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypter, err := NewSecretboxEncrypter(key, prefix, 4*1024)
 	if err != nil {
 		t.Fatal(err)
 	}
 	data := randData(encrypter.InBlockSize() * 10)
 	encrypted := TransformReader(bytes.NewReader(data),
 		encrypter, 0)
-	decrypter, err := NewSecretboxDecrypter(key, 4*1024)
+	decrypter, err := NewSecretboxDecrypter(key, prefix, 4*1024)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -41,3 +45,52 @@ func TestSecretbox(t *testing.T) {
 		t.Fatalf("encryption/decryption failed")
 	}
 }
+
+func TestSecretboxNonces(t *testing.T) {
+	key := randData(32)
+	var prefix1, prefix2 NoncePrefix
+	prefix2[0] = 1
+	enc1, err := NewSecretboxEncrypter(key, prefix1, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc2, err := NewSecretboxEncrypter(key, prefix2, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := randData(enc1.InBlockSize())
+	seal := func(enc Transformer, blockNum int64) string {
+		out, err := enc.Transform(nil, data, blockNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+
+	// the same block must encrypt differently in different streams, and
+	// block numbers must not wrap around.
+	seen := map[string]bool{}
+	for _, c := range []string{
+		seal(enc1, 1), seal(enc2, 1), seal(enc1, 1+1<<24), seal(enc1, 1+1<<32),
+	} {
+		if seen[c] {
+			t.Fatalf("nonce reused")
+		}
+		seen[c] = true
+	}
+
+	dec, err := NewSecretboxDecrypter(key, prefix1, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dec.Transform(nil, []byte(seal(enc2, 1)), 1); err == nil {
+		t.Fatalf("expected decrypting with the wrong prefix to fail")
+	}
+	plain, err := dec.Transform(nil, []byte(seal(enc1, 1+1<<32)), 1+1<<32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, data) {
+		t.Fatalf("decryption failed")
+	}
+}
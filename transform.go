@@ -5,6 +5,7 @@ package eestream
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 
@@ -19,43 +20,176 @@ type Transformer interface {
 	Transform(out, in []byte, blockNum int64) ([]byte, error)
 }
 
+// A FinalBlockTransformer is a Transformer that transforms the last block of
+// a stream differently from the others. Encrypters mark the final block this
+// way so that a stream with blocks cut off the end no longer decrypts. A
+// stream with no blocks at all has no final block either, so data that may
+// be empty has to be padded before it goes through one.
+type FinalBlockTransformer interface {
+	Transformer
+
+	// TransformFinal is like Transform, but for the last block of the stream.
+	TransformFinal(out, in []byte, blockNum int64) ([]byte, error)
+}
+
+// TruncatedError is the class of errors returned when a FinalBlockTransformer
+// finds that the stream ends before its final block.
+var TruncatedError = Error.NewClass("stream truncated")
+
 type transformedReader struct {
+	ctx      context.Context
 	r        io.Reader
 	t        Transformer
+	final    FinalBlockTransformer
 	blockNum int64
-	inbuf    []byte
-	outbuf   []byte
+	// lastBlock is the number of the final block, or -1 if the final block
+	// is only known once the next read hits io.EOF.
+	lastBlock int64
+	inbuf     []byte
+	nextbuf   []byte
+	peeked    bool
+	// peekErr is the error from reading the block after inbuf, to be
+	// returned once inbuf has been read.
+	peekErr error
+	ended   bool
+	// block holds the transformed block, and outbuf is what's left of it to
+	// read.
+	block  []byte
+	outbuf []byte
+	err    error
 }
 
 // TransformReader applies a Transformer to a Reader. startingBlockNum should
 // probably be 0 unless you know you're already starting at a block offset.
+// If t is a FinalBlockTransformer, TransformReader reads a block ahead so it
+// can treat the block before io.EOF as the final one.
 func TransformReader(r io.Reader, t Transformer,
 	startingBlockNum int64) io.Reader {
-	return &transformedReader{
-		r:        r,
-		t:        t,
-		blockNum: startingBlockNum,
-		inbuf:    make([]byte, t.InBlockSize()),
-		outbuf:   make([]byte, 0, t.OutBlockSize()),
+	return TransformReaderContext(context.Background(), r, t, startingBlockNum)
+}
+
+// TransformReaderContext is like TransformReader, but stops with ctx.Err()
+// once ctx is done.
+func TransformReaderContext(ctx context.Context, r io.Reader, t Transformer,
+	startingBlockNum int64) io.Reader {
+	return newTransformedReader(ctx, r, t, startingBlockNum, -1)
+}
+
+func newTransformedReader(ctx context.Context, r io.Reader, t Transformer,
+	startingBlockNum, lastBlock int64) *transformedReader {
+	rv := &transformedReader{
+		ctx:       ctx,
+		r:         r,
+		t:         t,
+		blockNum:  startingBlockNum,
+		lastBlock: lastBlock,
+		inbuf:     getBlock(t.InBlockSize()),
+		block:     getBlock(t.OutBlockSize()),
+	}
+	if final, ok := t.(FinalBlockTransformer); ok {
+		rv.final = final
+		if lastBlock < 0 {
+			rv.nextbuf = getBlock(t.InBlockSize())
+		}
 	}
+	return rv
 }
 
-func (t *transformedReader) Read(p []byte) (n int, err error) {
-	if len(t.outbuf) <= 0 {
+// release returns the reader's buffers to the pool once it's done.
+func (t *transformedReader) release() {
+	putBlock(t.inbuf)
+	putBlock(t.nextbuf)
+	putBlock(t.block)
+	t.inbuf, t.nextbuf, t.block = nil, nil, nil
+}
+
+// readBlock reads the next block into inbuf and reports whether it is the
+// final block of the stream.
+func (t *transformedReader) readBlock() (last bool, err error) {
+	if t.nextbuf == nil {
 		_, err = io.ReadFull(t.r, t.inbuf)
+		return t.final != nil && t.blockNum == t.lastBlock, err
+	}
+	if t.peekErr != nil {
+		return false, t.peekErr
+	}
+	if !t.peeked {
+		if t.ended {
+			return false, io.EOF
+		}
+		_, err = io.ReadFull(t.r, t.nextbuf)
+		if err == io.EOF {
+			return false, TruncatedError.New("stream has no final block")
+		}
 		if err != nil {
-			return 0, err
+			return false, err
+		}
+	}
+	t.inbuf, t.nextbuf = t.nextbuf, t.inbuf
+	_, err = io.ReadFull(t.r, t.nextbuf)
+	switch err {
+	case nil:
+		t.peeked = true
+	case io.EOF:
+		t.peeked, t.ended = false, true
+		return true, nil
+	default:
+		// inbuf is still good, so the error waits for the next block.
+		t.peekErr = err
+	}
+	return false, nil
+}
+
+// transform transforms inbuf. If the FinalBlockTransformer disagrees with the
+// stream about whether the block is the last one, transform says so rather
+// than returning a plain transform error.
+func (t *transformedReader) transform(last bool) (out []byte, err error) {
+	if !last {
+		out, err = t.t.Transform(t.block[:0], t.inbuf, t.blockNum)
+		if err != nil && t.final != nil {
+			_, ferr := t.final.TransformFinal(t.block[:0], t.inbuf, t.blockNum)
+			if ferr == nil {
+				return nil, Error.New("data after final block %d", t.blockNum)
+			}
+		}
+		return out, err
+	}
+	out, err = t.final.TransformFinal(t.block[:0], t.inbuf, t.blockNum)
+	if err != nil {
+		_, terr := t.t.Transform(t.block[:0], t.inbuf, t.blockNum)
+		if terr == nil {
+			return nil, TruncatedError.New("block %d is not the final block",
+				t.blockNum)
+		}
+	}
+	return out, err
+}
+
+func (t *transformedReader) Read(p []byte) (n int, err error) {
+	if err := t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(t.outbuf) <= 0 {
+		if t.err != nil {
+			return 0, t.err
+		}
+		last, err := t.readBlock()
+		if err == nil {
+			t.outbuf, err = t.transform(last)
+			if err != nil {
+				err = Error.Wrap(err)
+			}
 		}
-		t.outbuf, err = t.t.Transform(t.outbuf, t.inbuf, t.blockNum)
 		if err != nil {
-			return 0, Error.Wrap(err)
+			t.err = err
+			t.release()
+			return 0, err
 		}
 		t.blockNum += 1
 	}
 
 	n = copy(p, t.outbuf)
-	copy(t.outbuf, t.outbuf[n:])
-	t.outbuf = t.outbuf[:len(t.outbuf)-n]
+	t.outbuf = t.outbuf[n:]
 	return n, nil
 }
 
@@ -64,12 +198,16 @@ type transformedRanger struct {
 	t  Transformer
 }
 
-// Transform will apply a Transformer to a Ranger.
+// Transform will apply a Transformer to a Ranger. If t is a
+// FinalBlockTransformer, the last block of rr is the final block.
 func Transform(rr ranger.Ranger, t Transformer) (ranger.Ranger, error) {
 	if rr.Size()%int64(t.InBlockSize()) != 0 {
 		return nil, Error.New("invalid transformer and range reader combination." +
 			"the range reader size is not a multiple of the block size")
 	}
+	if _, ok := t.(FinalBlockTransformer); ok && rr.Size() == 0 {
+		return nil, TruncatedError.New("stream has no final block")
+	}
 	return &transformedRanger{rr: rr, t: t}, nil
 }
 
@@ -92,12 +230,18 @@ func calcEncompassingBlocks(offset, length int64, blockSize int) (
 }
 
 func (t *transformedRanger) Range(offset, length int64) io.Reader {
+	return t.RangeContext(context.Background(), offset, length)
+}
+
+func (t *transformedRanger) RangeContext(ctx context.Context,
+	offset, length int64) io.Reader {
 	firstBlock, blockCount := calcEncompassingBlocks(
 		offset, length, t.t.OutBlockSize())
-	r := TransformReader(
-		t.rr.Range(
+	lastBlock := t.rr.Size()/int64(t.t.InBlockSize()) - 1
+	r := newTransformedReader(ctx,
+		ranger.RangeContext(ctx, t.rr,
 			firstBlock*int64(t.t.InBlockSize()),
-			blockCount*int64(t.t.InBlockSize())), t.t, firstBlock)
+			blockCount*int64(t.t.InBlockSize())), t.t, firstBlock, lastBlock)
 	_, err := io.CopyN(ioutil.Discard, r,
 		offset-firstBlock*int64(t.t.OutBlockSize()))
 	if err != nil {
@@ -124,3 +124,90 @@ func TestCRCSubranges(t *testing.T) {
 		}
 	}
 }
+
+func TestFinalBlock(t *testing.T) {
+	const blocks = 10
+	key := randData(32)
+	prefix, err := NewNoncePrefix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cipher := range []struct {
+		name      string
+		encrypter func(key []byte, prefix NoncePrefix,
+			encryptedBlockSize int) (Transformer, error)
+		decrypter func(key []byte, prefix NoncePrefix,
+			encryptedBlockSize int) (Transformer, error)
+	}{
+		{"secretbox", NewSecretboxEncrypter, NewSecretboxDecrypter},
+		{"aesgcm", NewAESGCMEncrypter, NewAESGCMDecrypter},
+	} {
+		encrypter, err := cipher.encrypter(key, prefix, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypter, err := cipher.decrypter(key, prefix, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypt := func(data []byte) []byte {
+			out, err := ioutil.ReadAll(TransformReader(bytes.NewReader(data),
+				encrypter, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return out
+		}
+		data := randData(encrypter.InBlockSize() * (blocks + 1))
+		short := encrypt(data[:encrypter.InBlockSize()*blocks])
+		long := encrypt(data)
+		blockSize := encrypter.OutBlockSize()
+
+		for _, test := range []struct {
+			name      string
+			encrypted []byte
+			truncated bool
+		}{
+			{"intact", short, false},
+			{"truncated", short[:blockSize*(blocks-1)], true},
+			{"extended", append(append([]byte(nil), short...),
+				long[blockSize*blocks:]...), false},
+			{"empty", nil, true},
+		} {
+			intact := test.name == "intact"
+			check := func(how string, err error) {
+				if intact && err != nil {
+					t.Fatalf("%s %s %s: unexpected: %v",
+						cipher.name, test.name, how, err)
+				}
+				if !intact && err == nil {
+					t.Fatalf("%s %s %s: expected an error",
+						cipher.name, test.name, how)
+				}
+				if TruncatedError.Contains(err) != test.truncated {
+					t.Fatalf("%s %s %s: unexpected error: %v",
+						cipher.name, test.name, how, err)
+				}
+			}
+			_, err := ioutil.ReadAll(TransformReader(
+				bytes.NewReader(test.encrypted), decrypter, 0))
+			check("reader", err)
+			rr, err := Transform(ranger.ByteRanger(test.encrypted), decrypter)
+			if err == nil {
+				_, err = ioutil.ReadAll(rr.Range(0, rr.Size()))
+			}
+			check("ranger", err)
+		}
+
+		// a partial block at the end fails, but only after the blocks before
+		// it are read.
+		decrypted, err := ioutil.ReadAll(TransformReader(
+			bytes.NewReader(long[:blockSize*blocks+10]), decrypter, 0))
+		if err == nil {
+			t.Fatalf("%s partial: expected an error", cipher.name)
+		}
+		if !bytes.Equal(decrypted, data[:encrypter.InBlockSize()*blocks]) {
+			t.Fatalf("%s partial: read %d bytes", cipher.name, len(decrypted))
+		}
+	}
+}
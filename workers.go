@@ -0,0 +1,161 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// workerIdleTimeout is how long a worker's goroutine waits for its next
+// request before exiting, so that the workers of a Reader that is dropped
+// without being closed don't run forever. The next request starts a new one.
+var workerIdleTimeout = 10 * time.Second
+
+// pieceWorker reads blocks from a single piece on its own goroutine, so
+// pieces are read concurrently without starting goroutines for every block,
+// and a slow piece doesn't hold up the pieces that have already responded.
+type pieceWorker struct {
+	num     int
+	r       io.Reader
+	buf     []byte
+	results chan<- pieceResult
+	reqs    chan []byte
+	idle    time.Duration
+	next    int64 // the next block the worker will read
+	reading int64 // the block the worker is reading or last read
+	busy    bool
+
+	mu      sync.Mutex
+	running bool
+}
+
+func (w *pieceWorker) run() {
+	idle := time.NewTimer(w.idle)
+	defer idle.Stop()
+	for {
+		select {
+		case buf, ok := <-w.reqs:
+			if !ok {
+				return
+			}
+			_, err := io.ReadFull(w.r, buf)
+			w.results <- pieceResult{num: w.num, err: err}
+		case <-idle.C:
+			w.mu.Lock()
+			if len(w.reqs) == 0 {
+				w.running = false
+				w.mu.Unlock()
+				return
+			}
+			w.mu.Unlock()
+		}
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(w.idle)
+	}
+}
+
+// request asks the worker to read its next block, starting its goroutine
+// if it isn't running.
+func (w *pieceWorker) request() {
+	w.busy = true
+	w.reading = w.next
+	w.next++
+	w.mu.Lock()
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+	w.reqs <- w.buf
+	w.mu.Unlock()
+}
+
+// stop lets the worker's goroutine exit once it is done with its current
+// read.
+func (w *pieceWorker) stop() {
+	close(w.reqs)
+}
+
+// startWorkers starts a worker for every piece in rs, reading blocks into the
+// piece's buffer in bufs. The pieces start at block next. The workers send
+// their results on the returned channel.
+func startWorkers(rs map[int]io.Reader, bufs map[int][]byte, next int64) (
+	map[int]*pieceWorker, chan pieceResult) {
+	workers := make(map[int]*pieceWorker, len(rs))
+	// every worker has at most one outstanding result, so sends to results
+	// never block, and a worker can always exit once it's stopped.
+	results := make(chan pieceResult, len(rs))
+	for i, r := range rs {
+		w := &pieceWorker{
+			num:     i,
+			r:       r,
+			buf:     bufs[i],
+			results: results,
+			reqs:    make(chan []byte, 1),
+			idle:    workerIdleTimeout,
+			next:    next,
+		}
+		workers[i] = w
+		w.running = true
+		go w.run()
+	}
+	return workers, results
+}
+
+// stopWorkers lets every worker goroutine exit once it is done with its
+// current read, and removes them from workers.
+func stopWorkers(workers map[int]*pieceWorker) {
+	for i, w := range workers {
+		w.stop()
+		delete(workers, i)
+	}
+}
+
+// readAll has every worker read its next block and waits for all of them.
+// It returns the workers that were already at the end of their piece, and
+// the errors of the ones that failed.
+func readAll(ctx context.Context, workers map[int]*pieceWorker,
+	results <-chan pieceResult) (
+	eofs map[int]bool, failed map[int]error, err error) {
+	for _, w := range workers {
+		w.request()
+	}
+	eofs = map[int]bool{}
+	failed = map[int]error{}
+	for range workers {
+		var res pieceResult
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		workers[res.num].busy = false
+		switch {
+		case res.err == io.EOF:
+			eofs[res.num] = true
+		case res.err != nil:
+			failed[res.num] = res.err
+		}
+	}
+	return eofs, failed, nil
+}
+
+// closeAll closes every Closer in closers, returning the first error, and
+// empties closers so they are only closed once.
+func closeAll(closers *[]io.Closer) (err error) {
+	for _, c := range *closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	*closers = nil
+	return err
+}
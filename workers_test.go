@@ -0,0 +1,161 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jtolds/eestream/ranger"
+	"github.com/vivint/infectious"
+)
+
+// blockingReader blocks every Read until it is closed.
+type blockingReader struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newBlockingReader() *blockingReader {
+	return &blockingReader{closed: make(chan struct{})}
+}
+
+func (b *blockingReader) Read(p []byte) (n int, err error) {
+	<-b.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (b *blockingReader) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+// checkGoroutines fails if there are still more goroutines running than
+// there were before, once they've had a chance to exit.
+func checkGoroutines(t *testing.T, name string, before int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%s: leaked %d goroutines:\n%s", name,
+				runtime.NumGoroutine()-before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDecodeGoroutineLeaks(t *testing.T) {
+	fc, err := infectious.NewFEC(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRSScheme(fc, 64)
+	data := randData(rs.DecodedBlockSize() * 10)
+	pieces := encodePieces(t, data, rs)
+	rrs := map[int]ranger.Ranger{}
+	for i, piece := range pieces {
+		rrs[i] = ranger.ByteRanger(piece)
+	}
+	// without piece 1, ranges have to be erasure decoded.
+	decodeRRs := map[int]ranger.Ranger{0: rrs[0], 2: rrs[2], 3: rrs[3]}
+	defer func(idle time.Duration) { workerIdleTimeout = idle }(
+		workerIdleTimeout)
+	workerIdleTimeout = 10 * time.Millisecond
+	before := runtime.NumGoroutine()
+
+	for _, opts := range []DecoderOptions{
+		{}, {SkipLongTail: true}, {ReadAhead: 2},
+		{SkipLongTail: true, ReadAhead: 2},
+	} {
+		// reading to the end stops every goroutine without a Close.
+		readerMap := map[int]io.Reader{}
+		for i, piece := range pieces {
+			readerMap[i] = bytes.NewReader(piece)
+		}
+		_, err := ioutil.ReadAll(DecodeReadersWithOptions(readerMap, rs, opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGoroutines(t, "full read", before)
+
+		// so does reading all of a range that ends partway through a block,
+		// whether it's erasure decoded or stitched together.
+		var rangers []ranger.Ranger
+		for _, m := range []map[int]ranger.Ranger{rrs, decodeRRs} {
+			rr, err := DecodeWithOptions(m, rs, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rangers = append(rangers, rr)
+			_, err = ioutil.ReadAll(rr.Range(10, 300))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGoroutines(t, "range", before)
+		}
+
+		// a stream that fails early or is cancelled while pieces are stuck
+		// leaves the stuck reads to Close.
+		stuck := newBlockingReader()
+		readerMap = map[int]io.Reader{
+			0: &errReader{err: errBadDisk},
+			1: &errReader{err: errBadDisk},
+			2: bytes.NewReader(pieces[2]),
+			3: stuck,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(),
+			10*time.Millisecond)
+		r := DecodeReadersContext(ctx, readerMap, rs, opts)
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Fatalf("expected decode to fail")
+		}
+		cancel()
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		checkGoroutines(t, "failed read", before)
+		select {
+		case <-stuck.closed:
+		default:
+			t.Fatalf("expected stuck piece to be closed")
+		}
+
+		// a range that can't be cancelled and is dropped without a Close
+		// doesn't leave anything running once its workers are idle, unless
+		// it reads ahead.
+		if opts.ReadAhead < 1 {
+			for _, rr := range rangers {
+				r := rr.Range(10, rr.Size()-10)
+				if _, err := r.Read(make([]byte, 10)); err != nil {
+					t.Fatal(err)
+				}
+				checkGoroutines(t, "dropped range", before)
+			}
+		}
+
+		// and an abandoned stream just needs a Close.
+		for _, rr := range rangers {
+			r, ok := rr.Range(10, rr.Size()-10).(io.ReadCloser)
+			if !ok {
+				t.Fatalf("expected range to be an io.ReadCloser")
+			}
+			if _, err := r.Read(make([]byte, 10)); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.Read(make([]byte, 10)); err == nil {
+				t.Fatalf("expected read after close to fail")
+			}
+			checkGoroutines(t, "closed range", before)
+		}
+	}
+}
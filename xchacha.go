@@ -0,0 +1,171 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// xchachaStream holds what the XChaCha20-Poly1305 encrypter and decrypter
+// have in common.
+type xchachaStream struct {
+	blockSize   int
+	aead        cipher.AEAD
+	prefix      NoncePrefix
+	streamID    []byte
+	totalBlocks int64
+}
+
+func newXChaChaStream(key, streamID []byte, totalBlocks int64,
+	encryptedBlockSize int) (*xchachaStream, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	if encryptedBlockSize <= aead.Overhead() {
+		return nil, Error.New("block size too small")
+	}
+	if totalBlocks < 0 {
+		return nil, Error.New("invalid total block count")
+	}
+	// the nonce prefix is derived from the stream id, so stream ids must be
+	// unique for every stream encrypted with the same key.
+	var prefix NoncePrefix
+	sum := sha256.Sum256(streamID)
+	copy(prefix[:], sum[:])
+	return &xchachaStream{
+		blockSize:   encryptedBlockSize - aead.Overhead(),
+		aead:        aead,
+		prefix:      prefix,
+		streamID:    append([]byte(nil), streamID...),
+		totalBlocks: totalBlocks,
+	}, nil
+}
+
+// nonceAndAD returns the nonce and associated data for blockNum. The
+// associated data binds the block to its stream, its position, and the
+// length of the stream, so only block totalBlocks-1 can be the final block.
+func (s *xchachaStream) nonceAndAD(blockNum int64, final bool) (
+	nonce, ad []byte, err error) {
+	if blockNum < 0 || blockNum >= s.totalBlocks {
+		return nil, nil, Error.New("block %d out of range", blockNum)
+	}
+	if final != (blockNum == s.totalBlocks-1) {
+		return nil, nil, Error.New("block %d of %d can't be final: %v",
+			blockNum, s.totalBlocks, final)
+	}
+	ad = make([]byte, 0, 4+len(s.streamID)+8+8)
+	ad = appendUint32(ad, len(s.streamID))
+	ad = append(ad, s.streamID...)
+	ad = appendUint64(ad, uint64(blockNum))
+	ad = appendUint64(ad, uint64(s.totalBlocks))
+	return calcNonce(s.prefix, blockNum, final)[:], ad, nil
+}
+
+type xchachaEncrypter struct {
+	*xchachaStream
+}
+
+// NewXChaChaEncrypter returns a Transformer that encrypts the data passing
+// through with XChaCha20-Poly1305 and key. Every block is authenticated
+// along with streamID, its block number and totalBlocks, the number of
+// blocks in the stream, so blocks can't be moved to another stream or to
+// another position in the same stream. The last block must be transformed
+// with TransformFinal, which TransformReader and Transform take care of.
+// streamID must be unique for every stream encrypted with key.
+func NewXChaChaEncrypter(key, streamID []byte, totalBlocks int64,
+	encryptedBlockSize int) (Transformer, error) {
+	s, err := newXChaChaStream(key, streamID, totalBlocks, encryptedBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	return &xchachaEncrypter{xchachaStream: s}, nil
+}
+
+func (s *xchachaEncrypter) InBlockSize() int {
+	return s.blockSize
+}
+
+func (s *xchachaEncrypter) OutBlockSize() int {
+	return s.blockSize + s.aead.Overhead()
+}
+
+// Inverse implements InvertibleTransformer.
+func (s *xchachaEncrypter) Inverse() Transformer {
+	return &xchachaDecrypter{xchachaStream: s.xchachaStream}
+}
+
+func (s *xchachaEncrypter) Transform(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	return s.seal(out, in, blockNum, false)
+}
+
+func (s *xchachaEncrypter) TransformFinal(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	return s.seal(out, in, blockNum, true)
+}
+
+func (s *xchachaEncrypter) seal(out, in []byte, blockNum int64,
+	final bool) ([]byte, error) {
+	nonce, ad, err := s.nonceAndAD(blockNum, final)
+	if err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(out, nonce, in, ad), nil
+}
+
+type xchachaDecrypter struct {
+	*xchachaStream
+}
+
+// NewXChaChaDecrypter returns a Transformer that decrypts the data passing
+// through with XChaCha20-Poly1305 and key. streamID and totalBlocks must
+// match what the data was encrypted with.
+func NewXChaChaDecrypter(key, streamID []byte, totalBlocks int64,
+	encryptedBlockSize int) (Transformer, error) {
+	s, err := newXChaChaStream(key, streamID, totalBlocks, encryptedBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	return &xchachaDecrypter{xchachaStream: s}, nil
+}
+
+func (s *xchachaDecrypter) InBlockSize() int {
+	return s.blockSize + s.aead.Overhead()
+}
+
+func (s *xchachaDecrypter) OutBlockSize() int {
+	return s.blockSize
+}
+
+// Inverse implements InvertibleTransformer.
+func (s *xchachaDecrypter) Inverse() Transformer {
+	return &xchachaEncrypter{xchachaStream: s.xchachaStream}
+}
+
+func (s *xchachaDecrypter) Transform(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	return s.open(out, in, blockNum, false)
+}
+
+func (s *xchachaDecrypter) TransformFinal(out, in []byte, blockNum int64) (
+	[]byte, error) {
+	return s.open(out, in, blockNum, true)
+}
+
+func (s *xchachaDecrypter) open(out, in []byte, blockNum int64,
+	final bool) ([]byte, error) {
+	nonce, ad, err := s.nonceAndAD(blockNum, final)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := s.aead.Open(out, nonce, in, ad)
+	if err != nil {
+		return nil, Error.New("failed decrypting")
+	}
+	return rv, nil
+}
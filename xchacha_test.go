@@ -0,0 +1,78 @@
+// Copyright (C) 2018 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package eestream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jtolds/eestream/ranger"
+)
+
+func TestXChaCha(t *testing.T) {
+	const blocks = 10
+	key := randData(32)
+	streamID := []byte("stream 1")
+	encrypter, err := NewXChaChaEncrypter(key, streamID, blocks, 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := randData(encrypter.InBlockSize() * blocks)
+	encrypted, err := ioutil.ReadAll(TransformReader(bytes.NewReader(data),
+		encrypter, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypter, err := NewXChaChaDecrypter(key, streamID, blocks, 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := Transform(ranger.ByteRanger(encrypted), decrypter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Size() != int64(len(data)) {
+		t.Fatalf("unexpected decrypted size %d", rr.Size())
+	}
+	offset, length := int64(5000), int64(20000)
+	data2, err := ioutil.ReadAll(rr.Range(offset, length))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[offset:offset+length], data2) {
+		t.Fatalf("encryption/decryption failed")
+	}
+
+	block := encrypted[:encrypter.OutBlockSize()]
+
+	// blocks can't be moved around
+	if _, err := decrypter.Transform(nil, block, 1); err == nil {
+		t.Fatalf("expected decrypting a moved block to fail")
+	}
+
+	// blocks can't be moved to another stream
+	other, err := NewXChaChaDecrypter(key, []byte("stream 2"), blocks, 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Transform(nil, block, 0); err == nil {
+		t.Fatalf("expected decrypting a block from another stream to fail")
+	}
+
+	// the stream can't be truncated or extended
+	for _, total := range []int64{blocks - 1, blocks + 1} {
+		other, err := NewXChaChaDecrypter(key, streamID, total, 4*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Transform(nil, block, 0); err == nil {
+			t.Fatalf("expected decrypting with %d total blocks to fail", total)
+		}
+	}
+	if _, err := encrypter.Transform(nil, data[:encrypter.InBlockSize()],
+		blocks); err == nil {
+		t.Fatalf("expected encrypting past the last block to fail")
+	}
+}